@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	iam "github.com/netsoc/iam/client"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/netsoc/shh/pkg/server"
+	"github.com/netsoc/shh/pkg/util"
+)
+
+// subcommands are run instead of the server if the first argument matches
+var subcommands = map[string]func(args []string) error{
+	"check-config": checkConfig,
+	"render-jail":  renderJail,
+	"keygen":       keygen,
+}
+
+// newSubcommandFlags creates the flag set for a subcommand
+func newSubcommandFlags(name, usage string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %v %v %v\n", os.Args[0], name, usage)
+		flags.PrintDefaults()
+	}
+
+	return flags
+}
+
+// readConfig reads and parses the config (from file if set, otherwise the default locations) for a subcommand
+func readConfig(file string) (server.Config, error) {
+	var config server.Config
+
+	setupConfig(file)
+	if err := viper.ReadInConfig(); err != nil {
+		return config, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := viper.Unmarshal(&config, server.ConfigDecoderOptions); err != nil {
+		return config, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return config, nil
+}
+
+func checkConfig(args []string) error {
+	flags := newSubcommandFlags("check-config", "[--config <file>] [--iam] [--nsjail]")
+	file := flags.StringP("config", "c", "", "config file (searches the default locations if not set)")
+	checkIAM := flags.Bool("iam", false, "check that iamd is reachable and accepts the token")
+	checkNsjail := flags.Bool("nsjail", false, "validate the seccomp policy with nsjail")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	config, err := readConfig(*file)
+	if err != nil {
+		return err
+	}
+	if err := config.ReadSecrets(); err != nil {
+		return err
+	}
+
+	if err := config.Check(); err != nil {
+		return err
+	}
+	if err := util.CheckJailConfig(&config.Jail, *checkNsjail); err != nil {
+		return err
+	}
+
+	if *checkIAM {
+		if err := server.NewServer(config).CheckIAM(context.Background()); err != nil {
+			return fmt.Errorf("IAM check failed: %w", err)
+		}
+	}
+
+	fmt.Printf("%v is valid\n", viper.ConfigFileUsed())
+	return nil
+}
+
+func renderJail(args []string) error {
+	flags := newSubcommandFlags("render-jail", "[flags] <username> [command]")
+	file := flags.StringP("config", "c", "", "config file (searches the default locations if not set)")
+	admin := flags.Bool("admin", false, "render the jail for an IAM admin")
+	verified := flags.Bool("verified", true, "render the jail for a verified IAM user")
+	shell := flags.String("shell", "", "login shell (the profile's default if not set)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("expected a username and optional command")
+	}
+
+	config, err := readConfig(*file)
+	if err != nil {
+		return err
+	}
+	if err := util.CheckJailConfig(&config.Jail, false); err != nil {
+		return err
+	}
+
+	u := &iam.User{
+		Username: flags.Arg(0),
+		IsAdmin:  admin,
+		Verified: verified,
+	}
+	profile, c := config.Jail.ForUser(u)
+
+	opts := util.JailOptions{
+		Path:    os.Getenv("PATH"),
+		Profile: profile,
+		Shell:   *shell,
+	}
+	if c.Network.Interface != "" {
+		if opts.IP, err = util.NewIPAM(c.Network.Address, c.Network.Address.IP).Lease(); err != nil {
+			return err
+		}
+		if c.Network.Address6.IP != nil {
+			if opts.IP6, err = util.NewIPAM(c.Network.Address6, c.Network.Address6.IP).Lease(); err != nil {
+				return err
+			}
+		}
+	}
+
+	cfg, err := util.RenderJail(c, u, opts)
+	if err != nil {
+		return err
+	}
+
+	if profile != "" {
+		fmt.Printf("# Profile: %v\n", profile)
+	}
+	if flags.NArg() == 2 {
+		// Commands are run by the agent in the jail, not by nsjail itself
+		argv, err := json.Marshal(util.LoginArgv(u.Username, flags.Arg(1)))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# Agent runs: %s\n", argv)
+	}
+	os.Stdout.Write(cfg)
+
+	return nil
+}
+
+func keygen(args []string) error {
+	flags := newSubcommandFlags("keygen", "[--config <file>] [--dir <dir>]")
+	file := flags.StringP("config", "c", "", "config file (searches the default locations if not set)")
+	dir := flags.String("dir", "", "directory to generate keys in (the configured host key directory if not set)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("unexpected arguments")
+	}
+
+	if *dir == "" {
+		config, err := readConfig(*file)
+		if err != nil {
+			return err
+		}
+
+		*dir = config.HostKeyDir()
+	}
+
+	keys, err := server.LoadHostKeys(*dir)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		fmt.Printf("%v %v\n", k.PublicKey().Type(), gossh.FingerprintSHA256(k.PublicKey()))
+	}
+
+	return nil
+}
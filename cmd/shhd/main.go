@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/MakeNowJust/heredoc"
@@ -17,13 +18,20 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/netsoc/shh/pkg/server"
+	"github.com/netsoc/shh/pkg/util"
 )
 
-var srv *server.Server
+var (
+	// srvLock serialises reloads (which can be triggered by config changes, SIGHUP and shhctl at the same time) and
+	// guards srv
+	srvLock sync.Mutex
+	srv     *server.Server
+)
 
 func init() {
 	// Config defaults
 	viper.SetDefault("log_level", log.InfoLevel)
+	viper.SetDefault("state_dir", "/var/lib/shh")
 
 	viper.SetDefault("iam.url", "https://iam.netsoc.ie/v1")
 	viper.SetDefault("iam.token", "")
@@ -34,6 +42,27 @@ func init() {
 	viper.SetDefault("ssh.listen_address", ":22")
 	viper.SetDefault("ssh.host_keys", []ssh.Signer{})
 	viper.SetDefault("ssh.host_key_files", []string{})
+	viper.SetDefault("ssh.host_key_dir", "")
+
+	viper.SetDefault("http.listen_address", ":8080")
+	viper.SetDefault("http.admin_token", "")
+	viper.SetDefault("http.admin_token_file", "")
+
+	viper.SetDefault("audit.file", "-")
+
+	viper.SetDefault("webhooks.endpoints", []map[string]interface{}{})
+	viper.SetDefault("webhooks.queue_size", 256)
+	viper.SetDefault("webhooks.retries", 3)
+	viper.SetDefault("webhooks.timeout", 10*time.Second)
+	viper.SetDefault("webhooks.auth_failures.threshold", 10)
+	viper.SetDefault("webhooks.auth_failures.window", 10*time.Minute)
+
+	viper.SetDefault("pool.size", 0)
+	viper.SetDefault("pool.refill_interval", time.Second)
+
+	viper.SetDefault("sessions.detach_grace", 5*time.Minute)
+	viper.SetDefault("sessions.scrollback", 64*1024)
+	viper.SetDefault("sessions.broadcast_file", "")
 
 	viper.SetDefault("jail.tmp_dir", "/tmp/shh")
 	viper.SetDefault("jail.log_level", "WARNING")
@@ -44,6 +73,8 @@ func init() {
 	viper.SetDefault("jail.cgroups.pids", 64)
 	viper.SetDefault("jail.cgroups.cpu_time", 200)
 	viper.SetDefault("jail.home_size", 32*1024*1024)
+	viper.SetDefault("jail.home.backend", "tmpfs")
+	viper.SetDefault("jail.home.root", "/var/lib/shh/homes")
 	viper.SetDefault("jail.greeting", heredoc.Doc(`
 		Welcome to Netsoc SHH (not a typo :P).
 		The latest version of the CLI is pre-installed (type netsoc).
@@ -55,6 +86,38 @@ func init() {
 		"last_update_check": "9999-12-31T23:59:59Z",
 	})
 
+	viper.SetDefault("jail.dns.nameservers", []string{})
+	viper.SetDefault("jail.dns.search", []string{})
+	viper.SetDefault("jail.dns.options", []string{})
+	viper.SetDefault("jail.hosts", []map[string]interface{}{})
+	viper.SetDefault("jail.mounts", []map[string]interface{}{})
+	viper.SetDefault("jail.seccomp.policy", "")
+	viper.SetDefault("jail.seccomp.default", "allow")
+	viper.SetDefault("jail.seccomp.action", "errno")
+	viper.SetDefault("jail.seccomp.deny", []string{
+		// Kernel and system administration
+		"syslog", "init_module", "finit_module", "delete_module", "kexec_load", "kexec_file_load", "reboot",
+		"swapon", "swapoff", "acct", "quotactl", "iopl", "ioperm",
+		// Time
+		"settimeofday", "clock_settime", "clock_adjtime", "adjtimex",
+		// Namespaces and filesystems
+		"mount", "umount2", "pivot_root", "unshare", "setns", "open_by_handle_at", "name_to_handle_at",
+		// Kernel attack surface
+		"bpf", "perf_event_open", "userfaultfd", "keyctl", "add_key", "request_key", "lookup_dcookie",
+	})
+	viper.SetDefault("jail.seccomp.allow", []string{})
+	viper.SetDefault("jail.seccomp.log", false)
+	viper.SetDefault("jail.shells", map[string]string{
+		"fish": "/usr/bin/fish",
+		"bash": "/bin/bash",
+		"zsh":  "/bin/zsh",
+	})
+	viper.SetDefault("jail.shell", "fish")
+	viper.SetDefault("jail.session_duration", 0)
+	viper.SetDefault("jail.limit_help", "If you need higher limits, contact the Netsoc sysadmins.")
+	viper.SetDefault("jail.profiles", map[string]interface{}{})
+	viper.SetDefault("jail.profile_rules", []map[string]interface{}{})
+
 	viper.SetDefault("jail.network.interface", "")
 	ip, net, err := net.ParseCIDR("192.168.0.1/16")
 	if err != nil {
@@ -62,17 +125,48 @@ func init() {
 	}
 	net.IP = ip
 	viper.SetDefault("jail.network.address", net)
+	viper.SetDefault("jail.network.address6", "")
+	viper.SetDefault("jail.network.firewall.table", "shh")
+	viper.SetDefault("jail.network.firewall.default", "drop")
+	viper.SetDefault("jail.network.firewall.allow", []map[string]interface{}{
+		{"protocol": "udp", "ports": []uint16{53}},
+		{"protocol": "tcp", "ports": []uint16{53, 80, 443}},
+	})
+	viper.SetDefault("jail.network.firewall.block", []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"169.254.0.0/16",
+		"fc00::/7",
+		"fe80::/10",
+	})
+	viper.SetDefault("jail.network.bandwidth.egress", 0)
+	viper.SetDefault("jail.network.bandwidth.ingress", 0)
+	viper.SetDefault("jail.network.bandwidth.groups", map[string]interface{}{})
+}
 
+// setupConfig sets up config loading from a file (searching the default locations if file is empty) and the
+// environment
+func setupConfig(file string) {
 	// Config file loading
 	viper.SetConfigType("yaml")
-	viper.SetConfigName("shhd")
-	viper.AddConfigPath("/run/config")
-	viper.AddConfigPath(".")
+	if file != "" {
+		viper.SetConfigFile(file)
+	} else {
+		viper.SetConfigName("shhd")
+		viper.AddConfigPath("/run/config")
+		viper.AddConfigPath(".")
+	}
 
 	// Config from environment
 	viper.SetEnvPrefix("shhd")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
+}
+
+func loadConfig() {
+	setupConfig("")
 
 	// Config from flags
 	pflag.StringP("log_level", "l", "info", "log level")
@@ -87,6 +181,9 @@ func init() {
 }
 
 func reload() {
+	srvLock.Lock()
+	defer srvLock.Unlock()
+
 	if srv != nil {
 		stop()
 		srv = nil
@@ -111,13 +208,15 @@ func reload() {
 	srv = server.NewServer(config)
 
 	log.Info("Starting server")
+	s := srv
 	go func() {
-		if err := srv.Start(); err != nil {
+		if err := s.Start(); err != nil {
 			log.WithError(err).Fatal("Failed to start server")
 		}
 	}()
 }
 
+// stop stops the server (srvLock must be held)
 func stop() {
 	if err := srv.Stop(); err != nil {
 		log.WithError(err).Fatal("Failed to stop iamd server")
@@ -125,8 +224,25 @@ func stop() {
 }
 
 func main() {
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM)
+	if len(os.Args) == 3 && os.Args[1] == util.AgentCommand {
+		if err := util.RunJailAgent(os.Args[2]); err != nil {
+			log.WithError(err).Fatal("Jail agent failed")
+		}
+		return
+	}
+	if len(os.Args) >= 2 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.WithError(err).Fatalf("%v failed", os.Args[1])
+			}
+			return
+		}
+	}
+
+	loadConfig()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, unix.SIGINT, unix.SIGTERM, unix.SIGHUP, unix.SIGUSR1)
 
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		log.WithField("file", e.Name).Info("Config changed, reloading")
@@ -135,6 +251,28 @@ func main() {
 	viper.WatchConfig()
 	reload()
 
-	<-sigs
-	stop()
+	for sig := range sigs {
+		switch sig {
+		case unix.SIGHUP:
+			log.Info("Got SIGHUP, reloading")
+			if err := viper.ReadInConfig(); err != nil {
+				log.WithError(err).Warn("Failed to read config")
+			}
+			reload()
+		case unix.SIGUSR1:
+			srvLock.Lock()
+			if srv == nil {
+				log.Warn("Got SIGUSR1 while the server isn't running, not broadcasting")
+			} else if err := srv.BroadcastFile(); err != nil {
+				log.WithError(err).Error("Failed to broadcast message")
+			}
+			srvLock.Unlock()
+		default:
+			srvLock.Lock()
+			if srv != nil {
+				stop()
+			}
+			return
+		}
+	}
 }
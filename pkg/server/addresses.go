@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// maxKnownAddresses is the number of addresses remembered for each user
+const maxKnownAddresses = 32
+
+// knownAddresses remembers the addresses users have logged in from, so logins from new addresses can be reported
+type knownAddresses struct {
+	lock sync.Mutex
+	file string
+
+	Users map[string][]string `json:"users"`
+}
+
+func loadKnownAddresses(file string) (*knownAddresses, error) {
+	k := &knownAddresses{
+		file:  file,
+		Users: make(map[string][]string),
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known addresses: %w", err)
+	}
+
+	if err := json.Unmarshal(data, k); err != nil {
+		return nil, fmt.Errorf("failed to parse known addresses: %w", err)
+	}
+	if k.Users == nil {
+		k.Users = make(map[string][]string)
+	}
+
+	return k, nil
+}
+
+// save writes the known addresses to disk (k.lock must be held)
+func (k *knownAddresses) save() error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return fmt.Errorf("failed to encode known addresses: %w", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(k.file), 0o700); err != nil {
+		return fmt.Errorf("failed to create known addresses directory: %w", err)
+	}
+
+	tmp := k.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write known addresses: %w", err)
+	}
+	if err := os.Rename(tmp, k.file); err != nil {
+		return fmt.Errorf("failed to replace known addresses: %w", err)
+	}
+
+	return nil
+}
+
+// add records a login from an address, returning true if the user has logged in before but never from this address
+func (k *knownAddresses) add(username, address string) (bool, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	addrs := k.Users[username]
+	for i, a := range addrs {
+		if a == address {
+			// Move to the end so the least recently used addresses are forgotten first
+			copy(addrs[i:], addrs[i+1:])
+			addrs[len(addrs)-1] = address
+			return false, nil
+		}
+	}
+
+	addrs = append(addrs, address)
+	if len(addrs) > maxKnownAddresses {
+		addrs = addrs[len(addrs)-maxKnownAddresses:]
+	}
+	k.Users[username] = addrs
+
+	return len(addrs) > 1, k.save()
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	iam "github.com/netsoc/iam/client"
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminKillMessage is shown to users whose sessions are terminated by an administrator
+const adminKillMessage = "Your session was terminated by an administrator"
+
+type adminError struct {
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write admin API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, adminError{err.Error()})
+}
+
+// adminTokenUser is the admin name used for requests authenticated with the configured admin token
+const adminTokenUser = "admin-token"
+
+// adminTokenCacheTTL is how long an IAM token accepted by the admin API is trusted without checking with iamd again
+// (so a revoked token, or one for a user who is no longer an admin, is accepted for up to this long)
+const adminTokenCacheTTL = 10 * time.Second
+
+var errNotAdmin = errors.New("user is not an admin")
+
+// adminTokenCache remembers recently validated IAM tokens for admins (by hash)
+type adminTokenCache struct {
+	lock   sync.Mutex
+	tokens map[[sha256.Size]byte]cachedAdmin
+}
+
+type cachedAdmin struct {
+	name    string
+	expires time.Time
+}
+
+func (c *adminTokenCache) get(token string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	a, ok := c.tokens[sha256.Sum256([]byte(token))]
+	if !ok || time.Now().After(a.expires) {
+		return "", false
+	}
+
+	return a.name, true
+}
+
+func (c *adminTokenCache) add(token, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if c.tokens == nil {
+		c.tokens = make(map[[sha256.Size]byte]cachedAdmin)
+	}
+	for h, a := range c.tokens {
+		if now.After(a.expires) {
+			delete(c.tokens, h)
+		}
+	}
+
+	c.tokens[sha256.Sum256([]byte(token))] = cachedAdmin{name, now.Add(adminTokenCacheTTL)}
+}
+
+// adminUser checks an admin API token, which is either the configured admin token or an IAM token for an admin,
+// returning the name of the admin
+func (s *Server) adminUser(ctx context.Context, token string) (string, error) {
+	if s.config.HTTP.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(s.config.HTTP.AdminToken)) == 1 {
+		return adminTokenUser, nil
+	}
+	if name, ok := s.adminTokens.get(token); ok {
+		return name, nil
+	}
+
+	ctx = context.WithValue(ctx, iam.ContextAccessToken, token)
+	u, _, err := s.iam.UsersApi.GetUser(ctx, "self")
+	if err != nil {
+		return "", fmt.Errorf("failed to validate token: %w", util.APIError(err))
+	}
+	if u.IsAdmin == nil || !*u.IsAdmin {
+		return "", errNotAdmin
+	}
+
+	s.adminTokens.add(token, u.Username)
+	return u.Username, nil
+}
+
+// requireAdmin wraps an admin API handler to require a bearer token for an admin
+func (s *Server) requireAdmin(next func(w http.ResponseWriter, r *http.Request, admin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			writeError(w, http.StatusUnauthorized, errors.New("bearer token required"))
+			return
+		}
+
+		admin, err := s.adminUser(r.Context(), token)
+		if err != nil {
+			log.WithError(err).WithField("address", r.RemoteAddr).Warn("Admin API authentication failed")
+
+			// The details (e.g. errors from iamd) are only logged
+			if errors.Is(err, errNotAdmin) {
+				writeError(w, http.StatusForbidden, errors.New("admin access required"))
+			} else {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			}
+			return
+		}
+
+		next(w, r, admin)
+	}
+}
+
+// adminSessions lists sessions, optionally filtered by user (GET), or terminates all of a user's sessions (DELETE)
+func (s *Server) adminSessions(w http.ResponseWriter, r *http.Request, admin string) {
+	username := r.URL.Query().Get("user")
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.listSessions(username))
+	case http.MethodDelete:
+		if username == "" {
+			writeError(w, http.StatusBadRequest, errors.New("user is required"))
+			return
+		}
+
+		n := s.killSessions(0, username, "admin:"+admin, adminKillMessage)
+		writeJSON(w, http.StatusOK, map[string]int{"killed": n})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// adminSession terminates a single session (DELETE)
+func (s *Server) adminSession(w http.ResponseWriter, r *http.Request, admin string) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/sessions/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid session ID"))
+		return
+	}
+
+	if s.killSessions(id, "", "admin:"+admin, adminKillMessage) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("session not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"killed": 1})
+}
+
+// adminBroadcast writes a message to all terminals (POST)
+func (s *Server) adminBroadcast(w http.ResponseWriter, r *http.Request, admin string) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("failed to parse request: %w", err))
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("message is required"))
+		return
+	}
+
+	n := s.broadcast(admin, req.Message)
+	writeJSON(w, http.StatusOK, map[string]int{"terminals": n})
+}
+
+// registerAdminAPI adds the admin API's routes to a mux
+func (s *Server) registerAdminAPI(mux *http.ServeMux) {
+	mux.Handle("/admin/sessions", s.requireAdmin(s.adminSessions))
+	mux.Handle("/admin/sessions/", s.requireAdmin(s.adminSession))
+	mux.Handle("/admin/broadcast", s.requireAdmin(s.adminBroadcast))
+	mux.Handle("/admin/metrics", s.requireAdmin(func(w http.ResponseWriter, r *http.Request, _ string) {
+		expvar.Handler().ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// auditLog writes security-relevant events as JSON lines, separately from the debug log
+type auditLog struct {
+	log  *log.Logger
+	file *os.File
+}
+
+// openAuditLog opens the audit log at file ("-" for stdout)
+func openAuditLog(file string) (*auditLog, error) {
+	a := &auditLog{log: log.New()}
+	a.log.SetLevel(log.InfoLevel)
+	a.log.SetFormatter(&log.JSONFormatter{
+		FieldMap: log.FieldMap{
+			log.FieldKeyMsg: "event",
+		},
+	})
+
+	if file == "-" {
+		a.log.SetOutput(os.Stdout)
+		return a, nil
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	a.file = f
+	a.log.SetOutput(f)
+
+	return a, nil
+}
+
+// Close closes the audit log's file
+func (a *auditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+
+	return a.file.Close()
+}
+
+// audit records an event in the audit log (if enabled) and checks it for activity to report via webhooks
+func (s *Server) audit(event string, fields log.Fields) {
+	if s.auditLog != nil {
+		s.auditLog.log.WithFields(fields).Info(event)
+	}
+	if s.webhooks != nil {
+		s.webhooks.handle(event, fields)
+	}
+}
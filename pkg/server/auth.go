@@ -8,6 +8,7 @@ import (
 
 	"github.com/gliderlabs/ssh"
 	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
 
 	iam "github.com/netsoc/iam/client"
 	"github.com/netsoc/shh/pkg/util"
@@ -67,8 +68,28 @@ func (s *Server) doLogin(ctx ssh.Context, password string, key ssh.PublicKey) er
 	return nil
 }
 
+// auditAuth records an authentication attempt in the audit log
+func (s *Server) auditAuth(ctx ssh.Context, method string, key ssh.PublicKey, err error) {
+	fields := log.Fields{
+		"user":    ctx.User(),
+		"address": ctx.RemoteAddr().String(),
+		"method":  method,
+		"success": err == nil,
+	}
+	if key != nil {
+		fields["fingerprint"] = gossh.FingerprintSHA256(key)
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+
+	s.audit("auth", fields)
+}
+
 func (s *Server) handlePassword(ctx ssh.Context, password string) bool {
-	if err := s.doLogin(ctx, password, nil); err != nil {
+	err := s.doLogin(ctx, password, nil)
+	s.auditAuth(ctx, "password", nil, err)
+	if err != nil {
 		log.WithError(err).WithField("user", ctx.User()).Error("User failed to authenticate")
 		return false
 	}
@@ -76,7 +97,9 @@ func (s *Server) handlePassword(ctx ssh.Context, password string) bool {
 	return true
 }
 func (s *Server) handlePublicKey(ctx ssh.Context, key ssh.PublicKey) bool {
-	if err := s.doLogin(ctx, "", key); err != nil {
+	err := s.doLogin(ctx, "", key)
+	s.auditAuth(ctx, "publickey", key, err)
+	if err != nil {
 		log.WithError(err).WithField("user", ctx.User()).Error("User failed to authenticate with public key")
 		return false
 	}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"reflect"
 	"strings"
 	"time"
@@ -54,10 +56,18 @@ func stringToIPNetHookFunc() mapstructure.DecodeHookFunc {
 			return data, nil
 		}
 
+		// An empty string disables optional networks (e.g. IPv6)
+		if data.(string) == "" {
+			return net.IPNet{}, nil
+		}
+
 		// Convert it by parsing
-		ip, net, err := net.ParseCIDR(data.(string))
-		net.IP = ip
-		return net, err
+		ip, n, err := net.ParseCIDR(data.(string))
+		if err != nil {
+			return nil, err
+		}
+		n.IP = ip
+		return *n, nil
 	}
 }
 
@@ -75,6 +85,8 @@ func ConfigDecoderOptions(config *mapstructure.DecoderConfig) {
 // Config represents shhd's config
 type Config struct {
 	LogLevel log.Level `mapstructure:"log_level"`
+	// StateDir is where persistent state (e.g. user preferences) is stored
+	StateDir string `mapstructure:"state_dir"`
 
 	IAM struct {
 		URL           string
@@ -89,11 +101,89 @@ type Config struct {
 
 		HostKeys     []ssh.Signer `mapstructure:"host_keys"`
 		HostKeyFiles []string     `mapstructure:"host_key_files"`
+		// HostKeyDir is where host keys are generated if none are configured (state_dir/host_keys if empty)
+		HostKeyDir string `mapstructure:"host_key_dir"`
+	}
+
+	HTTP struct {
+		// ListenAddress is where health checks and the admin API are served (empty to disable). This is plain HTTP,
+		// so it must only be reachable from loopback or a private network.
+		ListenAddress string `mapstructure:"listen_address"`
+		// AdminToken grants access to the admin API (in addition to IAM tokens for admins)
+		AdminToken     string `mapstructure:"admin_token"`
+		AdminTokenFile string `mapstructure:"admin_token_file"`
+	}
+
+	Audit struct {
+		// File is where the JSON audit log is written ("-" for stdout, empty to disable)
+		File string
+	}
+
+	Webhooks struct {
+		Endpoints []Webhook
+		// QueueSize is the maximum number of deliveries waiting to be sent (further events are dropped)
+		QueueSize int `mapstructure:"queue_size"`
+		Retries   int
+		Timeout   time.Duration
+
+		// AuthFailures is the number of failed password logins from an address within a window to report
+		AuthFailures struct {
+			Threshold int
+			Window    time.Duration
+		} `mapstructure:"auth_failures"`
+	}
+
+	Pool struct {
+		// Size is the number of pre-started jails to keep ready (0 to disable)
+		Size           int
+		RefillInterval time.Duration `mapstructure:"refill_interval"`
+	}
+
+	Sessions struct {
+		DetachGrace time.Duration `mapstructure:"detach_grace"`
+		Scrollback  int
+		// BroadcastFile contains the message broadcast to all terminals on SIGUSR1 (state_dir/broadcast if empty)
+		BroadcastFile string `mapstructure:"broadcast_file"`
 	}
 
 	Jail util.JailConfig
 }
 
+// Check validates the server configuration (the jail configuration is checked separately, see
+// util.CheckJailConfig())
+func (c *Config) Check() error {
+	if _, _, err := net.SplitHostPort(c.SSH.ListenAddress); err != nil {
+		return fmt.Errorf("invalid SSH listen address: %w", err)
+	}
+	if c.HTTP.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.HTTP.ListenAddress); err != nil {
+			return fmt.Errorf("invalid HTTP listen address: %w", err)
+		}
+	}
+
+	if c.Pool.Size < 0 {
+		return errors.New("pool size must not be negative")
+	}
+	if c.Pool.Size > 0 && c.Pool.RefillInterval <= 0 {
+		return errors.New("pool refill interval must be positive")
+	}
+
+	for _, w := range c.Webhooks.Endpoints {
+		u, err := url.Parse(w.URL)
+		if err != nil {
+			return fmt.Errorf("invalid webhook URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook URL %v is not HTTP(S)", w.URL)
+		}
+	}
+	if len(c.Webhooks.Endpoints) > 0 && c.Webhooks.AuthFailures.Threshold <= 0 {
+		return errors.New("webhook auth failure threshold must be positive")
+	}
+
+	return nil
+}
+
 // ReadSecrets loads values for secret config options from files
 func (c *Config) ReadSecrets() error {
 	if c.IAM.TokenFile != "" {
@@ -105,6 +195,28 @@ func (c *Config) ReadSecrets() error {
 		c.IAM.Token = strings.TrimSpace(string(t))
 	}
 
+	if c.HTTP.AdminTokenFile != "" {
+		t, err := ioutil.ReadFile(c.HTTP.AdminTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read admin token file: %w", err)
+		}
+
+		c.HTTP.AdminToken = strings.TrimSpace(string(t))
+	}
+
+	for i := range c.Webhooks.Endpoints {
+		w := &c.Webhooks.Endpoints[i]
+		if w.SecretFile == "" {
+			continue
+		}
+
+		s, err := ioutil.ReadFile(w.SecretFile)
+		if err != nil {
+			return fmt.Errorf("failed to read webhook secret file: %w", err)
+		}
+		w.Secret = strings.TrimSpace(string(s))
+	}
+
 	for _, f := range c.SSH.HostKeyFiles {
 		data, err := ioutil.ReadFile(f)
 		if err != nil {
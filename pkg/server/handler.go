@@ -1,13 +1,13 @@
 package server
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
 	iam "github.com/netsoc/iam/client"
 	"github.com/netsoc/shh/pkg/util"
@@ -26,87 +26,146 @@ func (s *Server) shellSession(sess ssh.Session) error {
 	}
 
 	user := sess.Context().Value(keyUser).(*iam.User)
+	if isShhctl(command) {
+		return s.runShhctl(sess, user, command)
+	}
+
 	token := sess.Context().Value(keyUserToken).(string)
-	cmd, err := util.NewShellJail(&s.config.Jail, user, token, os.Getenv("PATH"), command)
-	if err != nil {
-		return fmt.Errorf("failed to create nsjail command: %w", err)
+	grace := s.config.Sessions.DetachGrace
+	if interactive && command == "" && grace > 0 {
+		if t := s.takeDetached(user.Username, sess); t != nil {
+			log.WithField("user", user.Username).Info("Reattaching detached terminal")
+			setSessionJail(sess, t.jail.Jail)
+			if err := t.jail.SetToken(token); err != nil {
+				log.WithError(err).WithField("user", user.Username).Warn("Failed to update token in jail")
+			}
+
+			setSessionKill(sess, t.hangUp)
+			return t.run(sess, sshPTY.Window, resizeChan, grace)
+		}
 	}
 
-	logR, logW, err := os.Pipe()
+	jail, err := s.acquireJail(user, token)
 	if err != nil {
-		return fmt.Errorf("failed to create log pipe: %w", err)
+		return err
 	}
-	defer logR.Close()
-	cmd.ExtraFiles = []*os.File{logW}
+	setSessionJail(sess, jail.Jail)
 
-	// TODO: Does SSH not actually forward signals at all?
-	sigChan := make(chan ssh.Signal)
-	sess.Signals(sigChan)
-	sigHandler := func() {
-		for s := range sigChan {
-			log.WithFields(log.Fields{
-				"signal": s,
-			}).Trace("Forwarding signal")
-			cmd.Process.Signal(util.SSHSignalToOS(s))
-		}
+	req := util.AgentRequest{
+		Argv: util.LoginArgv(user.Username, command),
+		TTY:  interactive,
 	}
 
 	if interactive {
-		cmd.Env = append(cmd.Env, "TERM="+sshPTY.Term)
+		req.Env = append(req.Env, "TERM="+sshPTY.Term)
 
-		ptmx, err := pty.StartWithSize(cmd, util.SSHToPTYSize(sshPTY.Window))
+		t, err := s.newTerminal(sess, jail, req, command, sshPTY.Window)
 		if err != nil {
-			return fmt.Errorf("failed to start interactive command: %w", err)
+			s.releaseJail(jail)
+			return err
 		}
-		defer ptmx.Close()
 
-		go io.Copy(log.StandardLogger().Out, logR)
+		setSessionKill(sess, t.hangUp)
+		return t.run(sess, sshPTY.Window, resizeChan, grace)
+	}
+	defer s.releaseJail(jail)
 
-		go sigHandler()
-		go func() {
-			for resize := range resizeChan {
-				pty.Setsize(ptmx, util.SSHToPTYSize(resize))
-			}
-		}()
+	stdinR, stdin, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
+	}
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdin.Close()
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdin.Close()
+		stdout.Close()
+		stdoutW.Close()
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+
+	proc, err := jail.Exec(req, stdinR, stdoutW, stderrW)
+	// The agent now holds the child ends of the pipes
+	stdinR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdin.Close()
+		return fmt.Errorf("failed to start command: %w", err)
+	}
 
-		go io.Copy(ptmx, sess)
-		go io.Copy(sess, ptmx)
-	} else {
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return fmt.Errorf("failed to create stdin pipe: %w", err)
-		}
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return fmt.Errorf("failed to create stdout pipe: %w", err)
-		}
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			return fmt.Errorf("failed to create stderr pipe: %w", err)
+	go func() {
+		// Close the command's stdin once the client sends EOF
+		if _, err := io.Copy(stdin, sess); err != nil {
+			log.WithError(err).Debug("Failed to copy session input to command")
 		}
+		stdin.Close()
+	}()
+
+	// All output must be read before reporting the exit status, otherwise the tail end may be lost
+	var outputWG sync.WaitGroup
+	outputWG.Add(2)
+	go func() {
+		defer outputWG.Done()
+		io.Copy(sess, stdout)
+	}()
+	go func() {
+		defer outputWG.Done()
+		io.Copy(sess.Stderr(), stderr)
+	}()
 
-		if err := cmd.Start(); err != nil {
-			return fmt.Errorf("failed to start command: %w", err)
+	// TODO: Does SSH not actually forward signals at all?
+	sigChan := make(chan ssh.Signal)
+	sess.Signals(sigChan)
+	go func() {
+		for s := range sigChan {
+			log.WithFields(log.Fields{
+				"signal": s,
+			}).Trace("Forwarding signal")
+			proc.Signal(util.SSHSignalToOS(s))
 		}
-
-		go io.Copy(log.StandardLogger().Out, logR)
-
-		go sigHandler()
-
-		go io.Copy(stdin, sess)
-		go io.Copy(sess, stdout)
-		go io.Copy(sess.Stderr(), stderr)
+	}()
+
+	exited := make(chan struct{})
+	setSessionKill(sess, func() {
+		hangUpProcess(log.WithField("user", user.Username), proc, exited)
+	})
+	if d := jail.config.SessionDuration; d > 0 {
+		limit := time.AfterFunc(d, func() {
+			l := log.WithField("user", user.Username)
+			l.Info("Command reached session duration limit, hanging up")
+			s.audit("session_killed", log.Fields{
+				"user":    user.Username,
+				"command": command,
+				"reason":  "session_duration",
+			})
+			fmt.Fprintf(sess.Stderr(), "[shh] Session time limit reached, hanging up\n")
+
+			hangUpProcess(l, proc, exited)
+		})
+		defer limit.Stop()
 	}
 
-	if err := cmd.Wait(); err != nil {
-		var exitErr *exec.ExitError
-		if errors.As(err, &exitErr) {
-			sess.Exit(exitErr.ExitCode())
-			return nil
-		}
+	code, err := proc.Wait()
+	close(exited)
+	outputWG.Wait()
+
+	// Check for limits being hit now so the user finds out why before the session closes
+	jail.Usage()
 
+	if err != nil {
 		return fmt.Errorf("command failed: %w", err)
 	}
+	if code != 0 {
+		sess.Exit(code)
+	}
 
 	return nil
 }
@@ -118,13 +177,50 @@ func (s *Server) doSession(sess ssh.Session) error {
 		"command": sess.RawCommand(),
 	}).Info("Opened SSH session")
 
+	if on, msg, err := s.maintenance(); err != nil {
+		log.WithError(err).Warn("Failed to check maintenance mode")
+	} else if on && !isAdmin(user) {
+		fmt.Fprintf(sess.Stderr(), "%v\r\n", msg)
+		sess.Exit(1)
+		return nil
+	}
+
 	// TODO: maybe if the user is doing a login skip allocating a jail and executing the CLI?
 	return s.shellSession(sess)
 }
 
 func (s *Server) handleSession(sess ssh.Session) {
-	if err := s.doSession(sess); err != nil {
-		fmt.Fprintf(sess.Stderr(), "Error: %v\r\n", err)
-		sess.Exit(-1)
+	a := s.addSession(sess)
+	defer s.removeSession(a)
+
+	s.audit("session_start", log.Fields{
+		"session":     a.ID,
+		"user":        a.User,
+		"address":     a.Address,
+		"command":     a.Command,
+		"interactive": a.Interactive,
+	})
+
+	err := s.doSession(a.sess)
+	if err != nil {
+		fmt.Fprintf(a.sess.Stderr(), "Error: %v\r\n", err)
+		a.sess.Exit(-1)
+	}
+
+	a.lock.Lock()
+	fields := log.Fields{
+		"session":     a.ID,
+		"user":        a.User,
+		"duration":    time.Since(a.Started).Seconds(),
+		"exit_status": a.exitStatus,
+		"bytes_in":    atomic.LoadUint64(&a.BytesIn),
+		"bytes_out":   atomic.LoadUint64(&a.BytesOut),
+		"jail_ip":     ipString(a.jailIP),
+		"jail_ip6":    ipString(a.jailIP6),
+	}
+	a.lock.Unlock()
+	if err != nil {
+		fields["error"] = err.Error()
 	}
+	s.audit("session_end", fields)
 }
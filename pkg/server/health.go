@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	iam "github.com/netsoc/iam/client"
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// healthCheckTimeout is the maximum time for checks which make network requests
+const healthCheckTimeout = 5 * time.Second
+
+// Health statuses
+const (
+	healthOK          = "ok"
+	healthDegraded    = "degraded"
+	healthUnavailable = "unavailable"
+)
+
+// healthCheck is the result of a single health check
+type healthCheck struct {
+	OK bool `json:"ok"`
+	// Critical is set for checks which make shhd unavailable if they fail (others only degrade it)
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func (r *healthReport) add(name string, critical bool, err error) {
+	c := healthCheck{OK: err == nil, Critical: critical}
+	if err != nil {
+		c.Error = err.Error()
+
+		switch {
+		case critical:
+			r.Status = healthUnavailable
+		case r.Status == healthOK:
+			r.Status = healthDegraded
+		}
+	}
+
+	r.Checks[name] = c
+}
+
+// checkSSH checks that the SSH server is accepting connections
+func (s *Server) checkSSH() error {
+	if s.sshListener == nil {
+		return errors.New("not listening")
+	}
+
+	conn, err := net.DialTimeout("tcp", s.sshListener.Addr().String(), healthCheckTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	conn.Close()
+
+	return nil
+}
+
+// CheckIAM checks that iamd is reachable and accepts shhd's token
+func (s *Server) CheckIAM(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, iam.ContextAccessToken, s.config.IAM.Token)
+	if _, err := s.iam.UsersApi.ValidateToken(ctx); err != nil {
+		return fmt.Errorf("failed to validate token: %w", util.APIError(err))
+	}
+
+	return nil
+}
+
+// health runs health checks (only those needed for liveness if ready is false)
+func (s *Server) health(ctx context.Context, ready bool) *healthReport {
+	r := &healthReport{
+		Status: healthOK,
+		Checks: make(map[string]healthCheck),
+	}
+
+	r.add("ssh", true, s.checkSSH())
+	if !ready {
+		return r
+	}
+
+	r.add("iam", true, s.CheckIAM(ctx))
+	for name, err := range util.CheckJailHost(&s.config.Jail) {
+		r.add(name, true, err)
+	}
+
+	if s.pool != nil {
+		var err error
+		if metricPoolReady.Value() == 0 {
+			err = errors.New("no pooled jails ready")
+		}
+		r.add("pool", false, err)
+	}
+	if s.webhooks != nil {
+		var err error
+		if len(s.webhooks.queue) == cap(s.webhooks.queue) {
+			err = errors.New("webhook queue full")
+		}
+		r.add("webhooks", false, err)
+	}
+
+	return r
+}
+
+func (s *Server) healthHandler(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := s.health(r.Context(), ready)
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == healthUnavailable {
+			log.WithField("report", report).Debug("Health check failed")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.WithError(err).Warn("Failed to write health report")
+		}
+	}
+}
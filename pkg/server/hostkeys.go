@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// hostKeyTypes are the types of host key generated (in order of preference)
+var hostKeyTypes = []struct {
+	name     string
+	generate func() (crypto.Signer, error)
+}{
+	{"ed25519", func() (crypto.Signer, error) {
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	}},
+	{"ecdsa", func() (crypto.Signer, error) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}},
+	{"rsa", func() (crypto.Signer, error) {
+		return rsa.GenerateKey(rand.Reader, 3072)
+	}},
+}
+
+// HostKeyDir returns the directory generated host keys are stored in
+func (c *Config) HostKeyDir() string {
+	if c.SSH.HostKeyDir != "" {
+		return c.SSH.HostKeyDir
+	}
+
+	return path.Join(c.StateDir, "host_keys")
+}
+
+// writeFileSync writes a file by replacing it with a fully written (and synced) temporary file, so a crash can't
+// leave it truncated
+func writeFileSync(file string, data []byte, perm os.FileMode) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// writeHostKey writes a private key (as PKCS #8) and its public key (in authorized_keys format)
+func writeHostKey(file string, k crypto.Signer) (ssh.Signer, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	signer, err := gossh.NewSignerFromSigner(k)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	// The public key is only written once the private key is in place
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := writeFileSync(file, data, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := writeFileSync(file+".pub", gossh.MarshalAuthorizedKey(signer.PublicKey()), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write public key: %w", err)
+	}
+
+	return signer, nil
+}
+
+// LoadHostKeys loads the host keys stored in dir, generating any which are missing
+func LoadHostKeys(dir string) ([]ssh.Signer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create host key directory: %w", err)
+	}
+
+	var keys []ssh.Signer
+	for _, t := range hostKeyTypes {
+		file := path.Join(dir, "ssh_host_"+t.name+"_key")
+
+		data, err := os.ReadFile(file)
+		if err == nil {
+			k, err := gossh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse host key %v: %w", file, err)
+			}
+
+			keys = append(keys, k)
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read host key %v: %w", file, err)
+		}
+
+		log.WithFields(log.Fields{
+			"type": t.name,
+			"file": file,
+		}).Info("Generating SSH host key")
+		k, err := t.generate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate %v host key: %w", t.name, err)
+		}
+
+		signer, err := writeHostKey(file, k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save host key %v: %w", file, err)
+		}
+		keys = append(keys, signer)
+	}
+
+	return keys, nil
+}
+
+// logHostKeys logs the fingerprints of host keys
+func logHostKeys(keys []ssh.Signer) {
+	for _, k := range keys {
+		log.WithFields(log.Fields{
+			"type":        k.PublicKey().Type(),
+			"fingerprint": gossh.FingerprintSHA256(k.PublicKey()),
+		}).Info("SSH host key")
+	}
+}
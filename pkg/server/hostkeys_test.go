@@ -0,0 +1,55 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestLoadHostKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "host_keys")
+
+	keys, err := LoadHostKeys(dir)
+	if err != nil {
+		t.Fatalf("failed to generate host keys: %v", err)
+	}
+	if len(keys) != len(hostKeyTypes) {
+		t.Fatalf("generated %v host keys, want %v", len(keys), len(hostKeyTypes))
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("failed to list host keys: %v", err)
+	}
+	if len(files) != 2*len(hostKeyTypes) {
+		t.Errorf("host key directory contains %v, want a private and public key for each type", files)
+	}
+
+	for _, kt := range hostKeyTypes {
+		file := filepath.Join(dir, "ssh_host_"+kt.name+"_key")
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+			t.Errorf("private key %v has mode %v (%v), want 0600", file, info.Mode(), err)
+		}
+	}
+
+	reloaded, err := LoadHostKeys(dir)
+	if err != nil {
+		t.Fatalf("failed to load host keys: %v", err)
+	}
+	for i, k := range reloaded {
+		want := gossh.FingerprintSHA256(keys[i].PublicKey())
+		if got := gossh.FingerprintSHA256(k.PublicKey()); got != want {
+			t.Errorf("host key %v changed from %v to %v when reloaded", i, want, got)
+		}
+
+		pub, err := os.ReadFile(filepath.Join(dir, "ssh_host_"+hostKeyTypes[i].name+"_key.pub"))
+		if err != nil {
+			t.Fatalf("failed to read public key: %v", err)
+		}
+		if string(pub) != string(gossh.MarshalAuthorizedKey(k.PublicKey())) {
+			t.Errorf("public key file %q doesn't match the private key", pub)
+		}
+	}
+}
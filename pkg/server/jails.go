@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	iam "github.com/netsoc/iam/client"
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// userJail is a jail shared between all of a user's sessions
+type userJail struct {
+	*util.Jail
+
+	// config is the jail configuration with the user's profile applied
+	config *util.JailConfig
+	// refs is the number of sessions using the jail and stopped is set once it has been stopped (both guarded by
+	// s.jailsLock)
+	refs    int
+	stopped bool
+}
+
+// userLock serialises starting and stopping a user's jail
+type userLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lockUser takes a user's jail lock, returning a function to release it. Jails are started and stopped with only
+// this lock held, so a slow jail doesn't hold up other users.
+func (s *Server) lockUser(username string) func() {
+	s.jailsLock.Lock()
+	l, ok := s.userLocks[username]
+	if !ok {
+		l = &userLock{}
+		s.userLocks[username] = l
+	}
+	l.waiters++
+	s.jailsLock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		s.jailsLock.Lock()
+		defer s.jailsLock.Unlock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(s.userLocks, username)
+		}
+	}
+}
+
+// addJail registers a user's new jail
+func (s *Server) addJail(j *userJail) {
+	s.jailsLock.Lock()
+	defer s.jailsLock.Unlock()
+
+	s.jails[j.User.Username] = j
+	s.liveJails[j] = struct{}{}
+}
+
+// waitJails waits for all jails to be stopped, returning false if ctx expires first
+func (s *Server) waitJails(ctx context.Context) bool {
+	for {
+		s.jailsLock.Lock()
+		n := len(s.liveJails)
+		s.jailsLock.Unlock()
+		if n == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// acquireJail returns the user's running jail (updating its token), starting a new one if necessary
+func (s *Server) acquireJail(u *iam.User, token string) (*userJail, error) {
+	unlock := s.lockUser(u.Username)
+	defer unlock()
+
+	// Jails started now wouldn't be stopped with the rest
+	select {
+	case <-s.stopping:
+		return nil, errors.New("server is shutting down")
+	default:
+	}
+
+	s.jailsLock.Lock()
+	j, ok := s.jails[u.Username]
+	s.jailsLock.Unlock()
+	if ok {
+		select {
+		case <-j.Done():
+			log.WithField("user", u.Username).Warn("User's jail exited unexpectedly, starting a new one")
+
+			s.jailsLock.Lock()
+			delete(s.jails, u.Username)
+			s.jailsLock.Unlock()
+		default:
+			if err := j.SetToken(token); err != nil {
+				return nil, fmt.Errorf("failed to update token in jail: %w", err)
+			}
+
+			s.jailsLock.Lock()
+			j.refs++
+			s.jailsLock.Unlock()
+			return j, nil
+		}
+	}
+
+	profile, c := s.config.Jail.ForUser(u)
+	if s.pool != nil && profile == "" {
+		jail := s.pool.claim(u, util.ClaimOptions{
+			Token:     token,
+			Shell:     s.userShell(u),
+			Bandwidth: c.Network.Bandwidth.ForUser(u),
+		})
+		if jail != nil {
+			log.WithFields(log.Fields{
+				"user": u.Username,
+				"ip":   jail.IP,
+				"ip6":  jail.IP6,
+			}).Debug("Claimed pooled jail")
+
+			j := &userJail{Jail: jail, config: c, refs: 1}
+			s.watchJail(j, true)
+			s.addJail(j)
+			return j, nil
+		}
+	}
+
+	home, err := util.AcquireHome(c, u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up home directory: %w", err)
+	}
+
+	releaseHome := func() {
+		if err := util.ReleaseHome(c, u); err != nil {
+			log.WithError(err).WithField("user", u.Username).Error("Failed to release home directory")
+		}
+	}
+
+	ip, ip6, err := s.leaseAddresses()
+	if err != nil {
+		releaseHome()
+		return nil, err
+	}
+
+	jail, err := util.StartJail(c, u, util.JailOptions{
+		Token:   token,
+		Path:    os.Getenv("PATH"),
+		Home:    home,
+		Profile: profile,
+		Shell:   s.userShell(u),
+
+		IP:  ip,
+		IP6: ip6,
+
+		Bandwidth: c.Network.Bandwidth.ForUser(u),
+	})
+	if err != nil {
+		s.releaseAddresses(ip, ip6)
+		releaseHome()
+		return nil, fmt.Errorf("failed to start jail: %w", err)
+	}
+	log.WithFields(log.Fields{
+		"user":    u.Username,
+		"profile": profile,
+		"ip":      jail.IP,
+		"ip6":     jail.IP6,
+	}).Debug("Started jail")
+
+	j = &userJail{Jail: jail, config: c, refs: 1}
+	s.watchJail(j, false)
+	s.addJail(j)
+	return j, nil
+}
+
+// watchJail notifies the user's sessions when their jail hits a resource limit and records the jail's nsjail log
+// lines in the audit log
+func (s *Server) watchJail(j *userJail, pooled bool) {
+	username := j.User.Username
+	j.OnLimit(func(e util.LimitEvent) {
+		s.notifyLimit(username, e)
+	})
+	j.OnLog(func(l util.JailLogLine) {
+		s.audit("jail_log", log.Fields{
+			"user":        username,
+			"sessions":    sessionIDs(s.userSessions(username)),
+			"level":       l.Level.String(),
+			"pid":         l.PID,
+			"nsjail_time": l.Time,
+			"message":     l.Message,
+		})
+	})
+
+	s.audit("jail_start", log.Fields{
+		"user":    username,
+		"profile": j.Profile,
+		"pooled":  pooled,
+		"ip":      ipString(j.IP),
+		"ip6":     ipString(j.IP6),
+	})
+}
+
+// releaseJail drops a session's reference to a jail, stopping it once no sessions are using it
+func (s *Server) releaseJail(j *userJail) {
+	unlock := s.lockUser(j.User.Username)
+	defer unlock()
+
+	s.jailsLock.Lock()
+	j.refs--
+	if j.refs > 0 || j.stopped {
+		s.jailsLock.Unlock()
+		return
+	}
+	j.stopped = true
+	if s.jails[j.User.Username] == j {
+		delete(s.jails, j.User.Username)
+	}
+	s.jailsLock.Unlock()
+
+	s.stopJail(j)
+}
+
+// stopAllJails stops all jails, regardless of whether sessions are still using them
+func (s *Server) stopAllJails() {
+	s.jailsLock.Lock()
+	jails := make([]*userJail, 0, len(s.liveJails))
+	for j := range s.liveJails {
+		jails = append(jails, j)
+	}
+	s.jailsLock.Unlock()
+
+	for _, j := range jails {
+		unlock := s.lockUser(j.User.Username)
+
+		s.jailsLock.Lock()
+		stop := !j.stopped
+		j.stopped = true
+		if s.jails[j.User.Username] == j {
+			delete(s.jails, j.User.Username)
+		}
+		s.jailsLock.Unlock()
+
+		if stop {
+			log.WithField("user", j.User.Username).Warn("Stopping jail which is still in use")
+			s.stopJail(j)
+		}
+		unlock()
+	}
+}
+
+// stopJail stops a jail and releases its resources (the user's jail lock must be held)
+func (s *Server) stopJail(j *userJail) {
+	defer func() {
+		s.jailsLock.Lock()
+		delete(s.liveJails, j)
+		s.jailsLock.Unlock()
+	}()
+
+	l := log.WithField("user", j.User.Username)
+	if err := j.Stop(); err != nil {
+		l.WithError(err).Error("Failed to stop jail")
+	}
+
+	usage := j.Usage()
+	recordUsage(j.User.Username, usage)
+	l.WithFields(log.Fields{
+		"duration":     usage.Duration.String(),
+		"peakMemory":   usage.PeakMemory,
+		"cpuTime":      usage.CPUTime.String(),
+		"peakPIDs":     usage.PeakPIDs,
+		"oomKills":     usage.OOMKills,
+		"pidLimitHits": usage.PIDLimitHits,
+		"rxBytes":      usage.RxBytes,
+		"txBytes":      usage.TxBytes,
+	}).Info("Jail resource usage")
+	fields := usageFields(usage)
+	fields["user"] = j.User.Username
+	fields["ip"] = ipString(j.IP)
+	fields["ip6"] = ipString(j.IP6)
+	s.audit("jail_stop", fields)
+	s.releaseAddresses(j.IP, j.IP6)
+	if err := util.ReleaseHome(j.config, j.User); err != nil {
+		l.WithError(err).Error("Failed to release home directory")
+	}
+	l.Debug("Stopped jail")
+}
+
+// leaseAddresses allocates addresses for a new jail
+func (s *Server) leaseAddresses() (net.IP, net.IP, error) {
+	var ip, ip6 net.IP
+	var err error
+	if s.ipam != nil {
+		if ip, err = s.ipam.Lease(); err != nil {
+			return nil, nil, fmt.Errorf("failed to allocate IP address for jail: %w", err)
+		}
+	}
+	if s.ipam6 != nil {
+		if ip6, err = s.ipam6.Lease(); err != nil {
+			s.releaseAddresses(ip, nil)
+			return nil, nil, fmt.Errorf("failed to allocate IPv6 address for jail: %w", err)
+		}
+	}
+
+	return ip, ip6, nil
+}
+
+// usageFields describes a jail's resource usage (with times in seconds)
+func usageFields(u util.JailUsage) log.Fields {
+	return log.Fields{
+		"duration":       u.Duration.Seconds(),
+		"peak_memory":    u.PeakMemory,
+		"cpu_time":       u.CPUTime.Seconds(),
+		"peak_pids":      u.PeakPIDs,
+		"oom_kills":      u.OOMKills,
+		"pid_limit_hits": u.PIDLimitHits,
+		"rx_bytes":       u.RxBytes,
+		"tx_bytes":       u.TxBytes,
+	}
+}
+
+// ipString formats an optional IP address (empty if unset)
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+func (s *Server) releaseAddresses(ip, ip6 net.IP) {
+	if ip != nil {
+		s.ipam.Release(ip)
+	}
+	if ip6 != nil {
+		s.ipam6.Release(ip6)
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// formatBytes formats a number of bytes with a binary unit
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// limitMessage explains a limit event to the user
+func (s *Server) limitMessage(e util.LimitEvent) string {
+	var msg string
+	switch e.Resource {
+	case "memory":
+		msg = fmt.Sprintf("A process was killed because your environment ran out of memory (limit %v, %v in use)",
+			formatBytes(e.Limit), formatBytes(e.Current))
+	case "pids":
+		msg = fmt.Sprintf("A process couldn't be started because your environment reached its limit of %v "+
+			"processes (%v running)", e.Limit, e.Current)
+	default:
+		msg = fmt.Sprintf("Your environment hit its %v limit", e.Resource)
+	}
+
+	if help := strings.TrimSpace(s.config.Jail.LimitHelp); help != "" {
+		msg += ". " + help
+	}
+	return msg
+}
+
+// notifyLimit tells all of a user's sessions that their jail hit a resource limit
+func (s *Server) notifyLimit(username string, e util.LimitEvent) {
+	log.WithFields(log.Fields{
+		"user":     username,
+		"resource": e.Resource,
+		"count":    e.Count,
+		"limit":    e.Limit,
+		"current":  e.Current,
+	}).Warn("Jail hit resource limit")
+	s.audit("limit", log.Fields{
+		"user":     username,
+		"resource": e.Resource,
+		"count":    e.Count,
+		"limit":    e.Limit,
+		"current":  e.Current,
+	})
+
+	msg := s.limitMessage(e)
+	for _, a := range s.userSessions(username) {
+		fmt.Fprintf(a.sess.Stderr(), "\r\n[shh] %v\r\n", msg)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// defaultMaintenanceMessage is shown to users who try to connect in maintenance mode if no message was given
+const defaultMaintenanceMessage = "shh is down for maintenance, please try again later."
+
+// maintenanceFile is the path of the file which puts shhd into maintenance mode while it exists (containing the
+// message shown to users)
+func (s *Server) maintenanceFile() string {
+	return path.Join(s.config.StateDir, "maintenance")
+}
+
+// maintenance returns whether shhd is in maintenance mode and the message to show users
+func (s *Server) maintenance() (bool, string, error) {
+	data, err := os.ReadFile(s.maintenanceFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", fmt.Errorf("failed to read maintenance file: %w", err)
+	}
+
+	msg := strings.TrimSpace(string(data))
+	if msg == "" {
+		msg = defaultMaintenanceMessage
+	}
+	return true, msg, nil
+}
+
+// setMaintenance turns maintenance mode on (with an optional message) or off
+func (s *Server) setMaintenance(on bool, msg string) error {
+	if !on {
+		if err := os.Remove(s.maintenanceFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove maintenance file: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := os.MkdirAll(s.config.StateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	if err := os.WriteFile(s.maintenanceFile(), []byte(msg+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write maintenance file: %w", err)
+	}
+
+	return nil
+}
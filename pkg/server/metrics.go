@@ -0,0 +1,45 @@
+package server
+
+import (
+	"expvar"
+
+	"github.com/netsoc/shh/pkg/util"
+)
+
+var (
+	metricPoolHits   = expvar.NewInt("shh_pool_hits")
+	metricPoolMisses = expvar.NewInt("shh_pool_misses")
+	metricPoolReady  = expvar.NewInt("shh_pool_ready")
+
+	// metricUsage accumulates the resource usage of jails by user
+	metricUsage = expvar.NewMap("shh_jail_usage")
+)
+
+// recordUsage adds a jail's resource usage to the user's totals (the user's jail lock must be held)
+func recordUsage(username string, u util.JailUsage) {
+	m, ok := metricUsage.Get(username).(*expvar.Map)
+	if !ok {
+		m = new(expvar.Map).Init()
+		metricUsage.Set(username, m)
+	}
+
+	m.Add("jails", 1)
+	m.AddFloat("seconds", u.Duration.Seconds())
+	m.AddFloat("cpu_seconds", u.CPUTime.Seconds())
+	m.Add("oom_kills", int64(u.OOMKills))
+	m.Add("pid_limit_hits", int64(u.PIDLimitHits))
+	m.Add("rx_bytes", int64(u.RxBytes))
+	m.Add("tx_bytes", int64(u.TxBytes))
+
+	// High-water marks across all of the user's jails
+	for key, v := range map[string]uint64{"peak_memory_bytes": u.PeakMemory, "peak_pids": u.PeakPIDs} {
+		peak, ok := m.Get(key).(*expvar.Int)
+		if !ok {
+			peak = new(expvar.Int)
+			m.Set(key, peak)
+		}
+		if int64(v) > peak.Value() {
+			peak.Set(int64(v))
+		}
+	}
+}
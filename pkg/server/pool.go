@@ -0,0 +1,172 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	iam "github.com/netsoc/iam/client"
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// jailPool keeps pre-started generic jails ready to be claimed by users logging in
+type jailPool struct {
+	s *Server
+
+	lock    sync.Mutex
+	ready   []*util.Jail
+	stopped bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newJailPool(s *Server) *jailPool {
+	return &jailPool{
+		s: s,
+
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// run refills the pool (starting at most one jail per refill interval) until it is shut down
+func (p *jailPool) run() {
+	defer close(p.done)
+
+	t := time.NewTicker(p.s.config.Pool.RefillInterval)
+	defer t.Stop()
+	for {
+		p.refill()
+
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// prune removes jails which have exited from the pool, returning them to be discarded (p.lock must be held)
+func (p *jailPool) prune() []*util.Jail {
+	var exited []*util.Jail
+	ready := p.ready[:0]
+	for _, j := range p.ready {
+		select {
+		case <-j.Done():
+			log.Warn("Pooled jail exited unexpectedly")
+			exited = append(exited, j)
+		default:
+			ready = append(ready, j)
+		}
+	}
+	p.ready = ready
+	metricPoolReady.Set(int64(len(p.ready)))
+
+	return exited
+}
+
+func (p *jailPool) refill() {
+	p.lock.Lock()
+	exited := p.prune()
+	n := len(p.ready)
+	p.lock.Unlock()
+	p.discard(exited...)
+	if n >= p.s.config.Pool.Size {
+		return
+	}
+
+	ip, ip6, err := p.s.leaseAddresses()
+	if err != nil {
+		log.WithError(err).Warn("Failed to allocate addresses for pooled jail")
+		return
+	}
+
+	j, err := util.StartPooledJail(&p.s.config.Jail, util.JailOptions{
+		Path: os.Getenv("PATH"),
+
+		IP:  ip,
+		IP6: ip6,
+	})
+	if err != nil {
+		p.s.releaseAddresses(ip, ip6)
+		log.WithError(err).Warn("Failed to start pooled jail")
+		return
+	}
+
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		p.discard(j)
+		return
+	}
+
+	p.ready = append(p.ready, j)
+	n = len(p.ready)
+	metricPoolReady.Set(int64(n))
+	p.lock.Unlock()
+	log.WithField("ready", n).Debug("Added jail to pool")
+}
+
+// discard stops pooled jails and releases their addresses (without holding p.lock, since stopping a jail can take a
+// while)
+func (p *jailPool) discard(jails ...*util.Jail) {
+	for _, j := range jails {
+		if err := j.Stop(); err != nil {
+			log.WithError(err).Warn("Failed to stop pooled jail")
+		}
+		p.s.releaseAddresses(j.IP, j.IP6)
+	}
+}
+
+// take removes the next ready jail from the pool (nil if there are none)
+func (p *jailPool) take() *util.Jail {
+	p.lock.Lock()
+	exited := p.prune()
+	var j *util.Jail
+	if len(p.ready) > 0 {
+		j = p.ready[0]
+		p.ready = p.ready[1:]
+		metricPoolReady.Set(int64(len(p.ready)))
+	}
+	p.lock.Unlock()
+
+	p.discard(exited...)
+	return j
+}
+
+// claim takes a jail from the pool and personalises it for a user, returning nil if none are available
+func (p *jailPool) claim(u *iam.User, opts util.ClaimOptions) *util.Jail {
+	for {
+		j := p.take()
+		if j == nil {
+			metricPoolMisses.Add(1)
+			return nil
+		}
+
+		if err := j.Claim(u, opts); err != nil {
+			log.WithError(err).WithField("user", u.Username).Warn("Failed to claim pooled jail")
+			p.discard(j)
+			continue
+		}
+
+		metricPoolHits.Add(1)
+		return j
+	}
+}
+
+// shutdown stops refilling the pool and stops all unclaimed jails
+func (p *jailPool) shutdown() {
+	close(p.stop)
+	<-p.done
+
+	p.lock.Lock()
+	p.stopped = true
+	ready := p.ready
+	p.ready = nil
+	metricPoolReady.Set(0)
+	p.lock.Unlock()
+
+	p.discard(ready...)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// preferences stores per-user settings which persist across jails and restarts
+type preferences struct {
+	lock sync.Mutex
+	file string
+
+	Shells map[string]string `json:"shells"`
+}
+
+func loadPreferences(file string) (*preferences, error) {
+	p := &preferences{
+		file:   file,
+		Shells: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preferences: %w", err)
+	}
+
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse preferences: %w", err)
+	}
+	if p.Shells == nil {
+		p.Shells = make(map[string]string)
+	}
+
+	return p, nil
+}
+
+// save writes the preferences to disk (p.lock must be held)
+func (p *preferences) save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode preferences: %w", err)
+	}
+
+	if err := os.MkdirAll(path.Dir(p.file), 0o700); err != nil {
+		return fmt.Errorf("failed to create preferences directory: %w", err)
+	}
+
+	// Write to a temporary file first so a crash can't leave a truncated file behind
+	tmp := p.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write preferences: %w", err)
+	}
+	if err := os.Rename(tmp, p.file); err != nil {
+		return fmt.Errorf("failed to replace preferences: %w", err)
+	}
+
+	return nil
+}
+
+// shell returns a user's preferred shell (or an empty string if they haven't chosen one)
+func (p *preferences) shell(username string) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.Shells[username]
+}
+
+// setShell sets (or clears, if shell is empty) a user's preferred shell
+func (p *preferences) setShell(username, shell string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if shell == "" {
+		delete(p.Shells, username)
+	} else {
+		p.Shells[username] = shell
+	}
+
+	return p.save()
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	iam "github.com/netsoc/iam/client"
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// activeSession is a connected SSH session
+type activeSession struct {
+	// BytesIn and BytesOut count session input and output (accessed atomically)
+	BytesIn  uint64
+	BytesOut uint64
+
+	ID          uint64
+	User        string
+	Address     string
+	Command     string
+	Interactive bool
+	Started     time.Time
+
+	lock sync.Mutex
+	// jailIP and jailIP6 are the addresses of the jail the session is running in (if any)
+	jailIP  net.IP
+	jailIP6 net.IP
+	// exitStatus is the status sent to the client (the server sends 0 if the handler returns without sending one)
+	exitStatus int
+	// kill hangs up the session's process (nil if the session has no process running)
+	kill func()
+
+	sess ssh.Session
+}
+
+// trackedSession wraps a session to record its I/O and exit status
+type trackedSession struct {
+	ssh.Session
+	a *activeSession
+}
+
+type countingWriter struct {
+	io.ReadWriter
+	n *uint64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ReadWriter.Write(p)
+	atomic.AddUint64(w.n, uint64(n))
+	return n, err
+}
+
+func (t *trackedSession) Read(p []byte) (int, error) {
+	n, err := t.Session.Read(p)
+	atomic.AddUint64(&t.a.BytesIn, uint64(n))
+	return n, err
+}
+func (t *trackedSession) Write(p []byte) (int, error) {
+	n, err := t.Session.Write(p)
+	atomic.AddUint64(&t.a.BytesOut, uint64(n))
+	return n, err
+}
+func (t *trackedSession) Stderr() io.ReadWriter {
+	return countingWriter{t.Session.Stderr(), &t.a.BytesOut}
+}
+func (t *trackedSession) Exit(code int) error {
+	t.a.lock.Lock()
+	t.a.exitStatus = code
+	t.a.lock.Unlock()
+
+	return t.Session.Exit(code)
+}
+
+// trackedSessionOf returns the active session for a session (nil if the session isn't tracked)
+func trackedSessionOf(sess ssh.Session) *activeSession {
+	t, ok := sess.(*trackedSession)
+	if !ok {
+		return nil
+	}
+
+	return t.a
+}
+
+// setSessionJail records the jail a session is running in
+func setSessionJail(sess ssh.Session, j *util.Jail) {
+	a := trackedSessionOf(sess)
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.jailIP = j.IP
+	a.jailIP6 = j.IP6
+}
+
+// setSessionKill sets the function used to terminate a session's process
+func setSessionKill(sess ssh.Session, kill func()) {
+	a := trackedSessionOf(sess)
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.kill = kill
+}
+
+// addSession registers a session as connected (the returned session's sess wraps the original to keep track of I/O)
+func (s *Server) addSession(sess ssh.Session) *activeSession {
+	_, _, interactive := sess.Pty()
+	a := &activeSession{
+		User:        sess.Context().Value(keyUser).(*iam.User).Username,
+		Address:     sess.RemoteAddr().String(),
+		Command:     sess.RawCommand(),
+		Interactive: interactive,
+		Started:     time.Now(),
+	}
+	a.sess = &trackedSession{Session: sess, a: a}
+
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	s.nextSessionID++
+	a.ID = s.nextSessionID
+	s.sessions[a.ID] = a
+	return a
+}
+
+func (s *Server) removeSession(a *activeSession) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	delete(s.sessions, a.ID)
+}
+
+// userSessions returns a user's connected sessions
+func (s *Server) userSessions(username string) []*activeSession {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	var sessions []*activeSession
+	for _, a := range s.sessions {
+		if a.User == username {
+			sessions = append(sessions, a)
+		}
+	}
+
+	return sessions
+}
+
+// sessionIDs returns the IDs of sessions
+func sessionIDs(sessions []*activeSession) []uint64 {
+	ids := make([]uint64, len(sessions))
+	for i, a := range sessions {
+		ids[i] = a.ID
+	}
+
+	return ids
+}
+
+// sessionInfo describes a connected session
+type sessionInfo struct {
+	ID          uint64    `json:"id"`
+	User        string    `json:"user"`
+	Address     string    `json:"address"`
+	Command     string    `json:"command"`
+	Interactive bool      `json:"interactive"`
+	Started     time.Time `json:"started"`
+	JailIP      string    `json:"jail_ip,omitempty"`
+	JailIP6     string    `json:"jail_ip6,omitempty"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+
+	// Usage is the resource usage of the user's jail (shared by all of their sessions)
+	Usage log.Fields `json:"usage,omitempty"`
+}
+
+// listSessions describes connected sessions (all sessions if username is empty), ordered by ID
+func (s *Server) listSessions(username string) []sessionInfo {
+	s.sessionsLock.Lock()
+	sessions := make([]*activeSession, 0, len(s.sessions))
+	for _, a := range s.sessions {
+		if username == "" || a.User == username {
+			sessions = append(sessions, a)
+		}
+	}
+	s.sessionsLock.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	usage := make(map[string]log.Fields)
+	infos := make([]sessionInfo, len(sessions))
+	for i, a := range sessions {
+		a.lock.Lock()
+		infos[i] = sessionInfo{
+			ID:          a.ID,
+			User:        a.User,
+			Address:     a.Address,
+			Command:     a.Command,
+			Interactive: a.Interactive,
+			Started:     a.Started,
+			JailIP:      ipString(a.jailIP),
+			JailIP6:     ipString(a.jailIP6),
+			BytesIn:     atomic.LoadUint64(&a.BytesIn),
+			BytesOut:    atomic.LoadUint64(&a.BytesOut),
+		}
+		a.lock.Unlock()
+
+		u, ok := usage[a.User]
+		if !ok {
+			s.jailsLock.Lock()
+			j := s.jails[a.User]
+			s.jailsLock.Unlock()
+
+			if j != nil {
+				u = usageFields(j.Usage())
+			}
+			usage[a.User] = u
+		}
+		infos[i].Usage = u
+	}
+
+	return infos
+}
+
+// killSession terminates a session, telling the user why
+func (s *Server) killSession(a *activeSession, reason, message string) {
+	log.WithFields(log.Fields{
+		"session": a.ID,
+		"user":    a.User,
+		"reason":  reason,
+	}).Info("Terminating session")
+	s.audit("session_killed", log.Fields{
+		"session": a.ID,
+		"user":    a.User,
+		"command": a.Command,
+		"reason":  reason,
+	})
+
+	fmt.Fprintf(a.sess.Stderr(), "\r\n[shh] %v\r\n", message)
+
+	a.lock.Lock()
+	kill := a.kill
+	a.lock.Unlock()
+	if kill == nil {
+		a.sess.Close()
+		return
+	}
+
+	go kill()
+}
+
+// killSessions terminates a connected session by ID (or all of a user's sessions if username is set), returning the
+// number of sessions terminated
+func (s *Server) killSessions(id uint64, username, reason, message string) int {
+	s.sessionsLock.Lock()
+	var sessions []*activeSession
+	for _, a := range s.sessions {
+		if (username != "" && a.User == username) || (username == "" && a.ID == id) {
+			sessions = append(sessions, a)
+		}
+	}
+	s.sessionsLock.Unlock()
+
+	for _, a := range sessions {
+		s.killSession(a, reason, message)
+	}
+	return len(sessions)
+}
+
+// killAllSessions terminates all connected sessions
+func (s *Server) killAllSessions(reason, message string) {
+	s.sessionsLock.Lock()
+	sessions := make([]*activeSession, 0, len(s.sessions))
+	for _, a := range s.sessions {
+		sessions = append(sessions, a)
+	}
+	s.sessionsLock.Unlock()
+
+	for _, a := range sessions {
+		s.killSession(a, reason, message)
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/gliderlabs/ssh"
+	iam "github.com/netsoc/iam/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// shhctlName is the name of the built-in command which is handled by shhd itself (instead of being run in a jail)
+const shhctlName = "shhctl"
+
+type shhctlCommand struct {
+	usage       string
+	description string
+	// admin commands are only available to IAM admins
+	admin bool
+	run   func(s *Server, sess ssh.Session, u *iam.User, args []string) error
+}
+
+var shhctlCommands = map[string]shhctlCommand{
+	"shell": {
+		usage:       "shell [<name>|default]",
+		description: "show or set your login shell",
+		run:         (*Server).shhctlShell,
+	},
+
+	"who": {
+		usage:       "who [--json] [<user>]",
+		description: "list connected sessions",
+		admin:       true,
+		run:         (*Server).shhctlWho,
+	},
+	"kill": {
+		usage:       "kill [--json] <session>|--user <user>",
+		description: "terminate a session or all of a user's sessions",
+		admin:       true,
+		run:         (*Server).shhctlKill,
+	},
+	"wall": {
+		usage:       "wall [--json] <message>",
+		description: "write a message to all terminals",
+		admin:       true,
+		run:         (*Server).shhctlWall,
+	},
+	"maintenance": {
+		usage:       "maintenance [--json] [on [<message>]|off]",
+		description: "show or set maintenance mode (refusing sessions from non-admins)",
+		admin:       true,
+		run:         (*Server).shhctlMaintenance,
+	},
+	"reload": {
+		usage:       "reload",
+		description: "reload configuration (disconnecting all sessions)",
+		admin:       true,
+		run:         (*Server).shhctlReload,
+	},
+}
+
+// isShhctl checks if a command should be handled by shhctl
+func isShhctl(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) != 0 && fields[0] == shhctlName
+}
+
+// isAdmin checks if a user is an IAM admin
+func isAdmin(u *iam.User) bool {
+	return u.IsAdmin != nil && *u.IsAdmin
+}
+
+func shhctlUsage(w io.Writer, admin bool) {
+	names := make([]string, 0, len(shhctlCommands))
+	for name, c := range shhctlCommands {
+		if !c.admin || admin {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "usage: %v <command> [args...]\n\ncommands:\n", shhctlName)
+	for _, name := range names {
+		c := shhctlCommands[name]
+		fmt.Fprintf(w, "  %-30v %v\n", c.usage, c.description)
+	}
+}
+
+// runShhctl runs a shhctl command
+func (s *Server) runShhctl(sess ssh.Session, u *iam.User, command string) error {
+	args := strings.Fields(command)[1:]
+	if len(args) == 0 || args[0] == "help" {
+		shhctlUsage(sess, isAdmin(u))
+		return nil
+	}
+
+	c, ok := shhctlCommands[args[0]]
+	if !ok || (c.admin && !isAdmin(u)) {
+		shhctlUsage(sess.Stderr(), isAdmin(u))
+		return fmt.Errorf("unknown command %v", args[0])
+	}
+
+	log.WithFields(log.Fields{
+		"user":    u.Username,
+		"command": args,
+	}).Debug("Running shhctl command")
+	if c.admin {
+		s.audit("admin_command", log.Fields{
+			"user":    u.Username,
+			"address": sess.RemoteAddr().String(),
+			"command": args,
+		})
+	}
+
+	return c.run(s, sess, u, args[1:])
+}
+
+// userShell returns the name of the shell a user's jail should use
+func (s *Server) userShell(u *iam.User) string {
+	_, c := s.config.Jail.ForUser(u)
+	if pref := s.prefs.shell(u.Username); pref != "" {
+		if _, err := c.ShellPath(pref); err == nil {
+			return pref
+		}
+	}
+
+	return c.Shell
+}
+
+func (s *Server) shhctlShell(sess ssh.Session, u *iam.User, args []string) error {
+	switch len(args) {
+	case 0:
+		fmt.Fprintf(sess, "Current shell: %v\n", s.userShell(u))
+		fmt.Fprintf(sess, "Available shells: %v\n", strings.Join(s.config.Jail.ShellNames(), ", "))
+		return nil
+	case 1:
+	default:
+		return errors.New("too many arguments")
+	}
+
+	shell := args[0]
+	if shell == "default" {
+		shell = ""
+	} else if _, err := s.config.Jail.ShellPath(shell); err != nil {
+		return err
+	}
+
+	if err := s.prefs.setShell(u.Username, shell); err != nil {
+		log.WithError(err).WithField("user", u.Username).Error("Failed to save shell preference")
+		return errors.New("failed to save shell preference")
+	}
+
+	fmt.Fprintf(sess, "Login shell set to %v (applies to new sessions once all current ones have closed)\n",
+		s.userShell(u))
+	return nil
+}
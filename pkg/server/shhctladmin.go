@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	iam "github.com/netsoc/iam/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadDelay is the maximum time to wait for the session requesting a reload to close
+const reloadDelay = 5 * time.Second
+
+// shhctlJSON removes the --json flag from a command's arguments, returning whether it was present
+func shhctlJSON(args []string) ([]string, bool) {
+	rest := make([]string, 0, len(args))
+	found := false
+	for _, a := range args {
+		if a == "--json" || a == "-j" {
+			found = true
+			continue
+		}
+
+		rest = append(rest, a)
+	}
+
+	return rest, found
+}
+
+func writeShhctlJSON(sess ssh.Session, v interface{}) error {
+	e := json.NewEncoder(sess)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+func (s *Server) shhctlWho(sess ssh.Session, u *iam.User, args []string) error {
+	args, asJSON := shhctlJSON(args)
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+
+	var username string
+	if len(args) == 1 {
+		username = args[0]
+	}
+
+	sessions := s.listSessions(username)
+	if asJSON {
+		return writeShhctlJSON(sess, sessions)
+	}
+
+	w := tabwriter.NewWriter(sess, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tFROM\tSTARTED\tCOMMAND\tJAIL IP\tPEAK MEMORY\tIN\tOUT")
+	for _, i := range sessions {
+		command := i.Command
+		switch {
+		case command == "":
+			command = "-"
+		case len(command) > 30:
+			command = command[:27] + "..."
+		}
+		jailIP := i.JailIP
+		if jailIP == "" {
+			jailIP = "-"
+		}
+		memory := "-"
+		if m, ok := i.Usage["peak_memory"].(uint64); ok {
+			memory = formatBytes(m)
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", i.ID, i.User, i.Address,
+			i.Started.Format(time.Stamp), command, jailIP, memory, formatBytes(i.BytesIn), formatBytes(i.BytesOut))
+	}
+
+	return w.Flush()
+}
+
+func (s *Server) shhctlKill(sess ssh.Session, u *iam.User, args []string) error {
+	args, asJSON := shhctlJSON(args)
+
+	var n int
+	switch {
+	case len(args) == 2 && (args[0] == "--user" || args[0] == "-u"):
+		n = s.killSessions(0, args[1], "admin:"+u.Username, adminKillMessage)
+	case len(args) == 1:
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return errors.New("invalid session ID")
+		}
+		if a := trackedSessionOf(sess); a != nil && a.ID == id {
+			return errors.New("refusing to kill this session")
+		}
+
+		n = s.killSessions(id, "", "admin:"+u.Username, adminKillMessage)
+		if n == 0 {
+			return errors.New("session not found")
+		}
+	default:
+		return errors.New("expected a session ID or --user <user>")
+	}
+
+	if asJSON {
+		return writeShhctlJSON(sess, map[string]int{"killed": n})
+	}
+
+	fmt.Fprintf(sess, "Terminated %v session(s)\n", n)
+	return nil
+}
+
+func (s *Server) shhctlWall(sess ssh.Session, u *iam.User, args []string) error {
+	args, asJSON := shhctlJSON(args)
+	if len(args) == 0 {
+		return errors.New("message is required")
+	}
+
+	n := s.broadcast(u.Username, strings.Join(args, " "))
+	if asJSON {
+		return writeShhctlJSON(sess, map[string]int{"terminals": n})
+	}
+
+	fmt.Fprintf(sess, "Message sent to %v terminal(s)\n", n)
+	return nil
+}
+
+func (s *Server) shhctlMaintenance(sess ssh.Session, u *iam.User, args []string) error {
+	args, asJSON := shhctlJSON(args)
+	if len(args) != 0 {
+		var err error
+		switch args[0] {
+		case "on":
+			err = s.setMaintenance(true, strings.Join(args[1:], " "))
+		case "off":
+			if len(args) > 1 {
+				return errors.New("too many arguments")
+			}
+			err = s.setMaintenance(false, "")
+		default:
+			return errors.New("expected on or off")
+		}
+		if err != nil {
+			log.WithError(err).Error("Failed to set maintenance mode")
+			return errors.New("failed to set maintenance mode")
+		}
+
+		log.WithFields(log.Fields{
+			"user":        u.Username,
+			"maintenance": args[0],
+		}).Info("Maintenance mode changed")
+	}
+
+	on, msg, err := s.maintenance()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return writeShhctlJSON(sess, map[string]interface{}{
+			"maintenance": on,
+			"message":     msg,
+		})
+	}
+
+	if on {
+		fmt.Fprintf(sess, "Maintenance mode is on: %v\n", msg)
+	} else {
+		fmt.Fprintln(sess, "Maintenance mode is off")
+	}
+	return nil
+}
+
+func (s *Server) shhctlReload(sess ssh.Session, u *iam.User, args []string) error {
+	if len(args) != 0 {
+		return errors.New("too many arguments")
+	}
+
+	log.WithField("user", u.Username).Info("Reload requested")
+	fmt.Fprintln(sess, "Reloading configuration, all sessions will be disconnected")
+
+	// shhd reloads on SIGHUP, which restarts the server (so give this session a chance to finish first)
+	go func() {
+		select {
+		case <-sess.Context().Done():
+		case <-time.After(reloadDelay):
+		}
+
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			log.WithError(err).Error("Failed to send reload signal")
+		}
+	}()
+
+	return nil
+}
@@ -5,16 +5,27 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"path"
+	"sync"
 	"time"
 
 	"github.com/gliderlabs/ssh"
 	iam "github.com/netsoc/iam/client"
 	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
 )
 
 type key int
 
+// stopTimeout is the maximum time Stop() waits for sessions to end after hanging them up (before closing connections
+// and stopping any remaining jails)
+const stopTimeout = hangupKillTimeout + 5*time.Second
+
+// shutdownMessage is shown to users whose sessions are terminated when the server stops
+const shutdownMessage = "The server is restarting, your session has been terminated"
+
 const (
 	keyUser = iota
 	keyUserToken
@@ -25,8 +36,42 @@ const (
 type Server struct {
 	config Config
 
-	iam *iam.APIClient
-	ssh *ssh.Server
+	iam  *iam.APIClient
+	ssh  *ssh.Server
+	ipam *util.IPAM
+	// ipam6 is nil unless IPv6 is enabled for jails
+	ipam6 *util.IPAM
+
+	// sshListener is nil until the SSH server is listening
+	sshListener net.Listener
+	http        *http.Server
+	// stopping is closed when the server starts shutting down
+	stopping chan struct{}
+
+	// jailsLock guards jails and userLocks (but isn't held while jails start or stop, see lockUser())
+	jailsLock sync.Mutex
+	jails     map[string]*userJail
+	userLocks map[string]*userLock
+	// liveJails holds all jails which haven't been stopped (including ones replaced in jails after exiting
+	// unexpectedly)
+	liveJails map[*userJail]struct{}
+
+	terminalsLock sync.Mutex
+	terminals     map[string][]*terminal
+
+	sessionsLock  sync.Mutex
+	sessions      map[uint64]*activeSession
+	nextSessionID uint64
+
+	prefs *preferences
+	// auditLog is nil if the audit log is disabled
+	auditLog *auditLog
+	// webhooks is nil if no webhooks are configured
+	webhooks *webhooks
+	// pool is nil if jail pooling is disabled
+	pool *jailPool
+
+	adminTokens adminTokenCache
 }
 
 // NewServer creates a new shhd server
@@ -53,6 +98,30 @@ func NewServer(c Config) *Server {
 			Addr:        c.SSH.ListenAddress,
 			HostSigners: c.SSH.HostKeys,
 		},
+
+		jails:     make(map[string]*userJail),
+		userLocks: make(map[string]*userLock),
+		liveJails: make(map[*userJail]struct{}),
+		terminals: make(map[string][]*terminal),
+		sessions:  make(map[uint64]*activeSession),
+		stopping:  make(chan struct{}),
+	}
+
+	if c.Jail.Network.Interface != "" {
+		s.ipam = util.NewIPAM(c.Jail.Network.Address, c.Jail.Network.Address.IP)
+
+		if c.Jail.Network.Address6.IP != nil {
+			s.ipam6 = util.NewIPAM(c.Jail.Network.Address6, c.Jail.Network.Address6.IP)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", s.healthHandler(false))
+	mux.Handle("/readyz", s.healthHandler(true))
+	s.registerAdminAPI(mux)
+	s.http = &http.Server{
+		Addr:    c.HTTP.ListenAddress,
+		Handler: mux,
 	}
 
 	s.ssh.Handle(s.handleSession)
@@ -64,21 +133,118 @@ func NewServer(c Config) *Server {
 
 // Start starts the shhd server
 func (s *Server) Start() error {
+	if err := s.config.Check(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	if err := util.InitJail(&s.config.Jail); err != nil {
 		return fmt.Errorf("failed to initialize shell jail: %w", err)
 	}
 
-	if err := s.ssh.ListenAndServe(); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
+	prefs, err := loadPreferences(path.Join(s.config.StateDir, "preferences.json"))
+	if err != nil {
+		return err
+	}
+	s.prefs = prefs
+
+	if s.config.Audit.File != "" {
+		if s.auditLog, err = openAuditLog(s.config.Audit.File); err != nil {
+			return err
+		}
+	}
+
+	if len(s.config.Webhooks.Endpoints) > 0 {
+		if s.webhooks, err = newWebhooks(s); err != nil {
+			return err
+		}
+		go s.webhooks.run()
+	}
+
+	if s.config.Pool.Size > 0 {
+		if s.config.Jail.Home.Backend == util.HomeBackendTmpfs {
+			s.pool = newJailPool(s)
+			go s.pool.run()
+		} else {
+			log.WithField("backend", s.config.Jail.Home.Backend).
+				Warn("Jail pool is only supported with tmpfs home directories, disabling")
+		}
+	}
+
+	if len(s.config.SSH.HostKeys) == 0 {
+		keys, err := LoadHostKeys(s.config.HostKeyDir())
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			s.ssh.AddHostKey(k)
+		}
+	}
+	logHostKeys(s.ssh.HostSigners)
+
+	l, err := net.Listen("tcp", s.config.SSH.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SSH connections: %w", err)
+	}
+	s.sshListener = l
+
+	if s.config.HTTP.ListenAddress != "" {
+		go func() {
+			if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Error("HTTP server failed")
+			}
+		}()
+	}
+
+	if err := s.ssh.Serve(l); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
 		return err
 	}
 
 	return nil
 }
 
-// Stop shuts down the shhd server
+// Stop shuts down the shhd server, terminating all sessions and stopping all jails
 func (s *Server) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	close(s.stopping)
+	if s.pool != nil {
+		s.pool.shutdown()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
 	defer cancel()
 
-	return s.ssh.Shutdown(ctx)
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Failed to shut down HTTP server")
+	}
+
+	// Stop accepting connections (Shutdown() returns once the remaining ones have closed)
+	sshDone := make(chan error, 1)
+	go func() {
+		sshDone <- s.ssh.Shutdown(ctx)
+	}()
+
+	// Nothing can be reattached once the server has stopped, so hang everything up
+	s.killAllSessions("shutdown", shutdownMessage)
+	s.hangUpDetached()
+
+	if !s.waitJails(ctx) {
+		log.Warn("Timed out waiting for sessions to end")
+	}
+
+	err := s.ssh.Close()
+	if sErr := <-sshDone; sErr != nil && !errors.Is(sErr, context.DeadlineExceeded) {
+		err = sErr
+	}
+	s.stopAllJails()
+
+	if s.webhooks != nil {
+		s.webhooks.shutdown()
+	}
+	if s.auditLog != nil {
+		if cErr := s.auditLog.Close(); cErr != nil {
+			log.WithError(cErr).Warn("Failed to close audit log")
+		}
+	}
+
+	return err
 }
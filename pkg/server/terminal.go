@@ -0,0 +1,360 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gliderlabs/ssh"
+	"github.com/netsoc/shh/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// hangupKillTimeout is how long to wait after sending SIGHUP to a process before killing it
+const hangupKillTimeout = 10 * time.Second
+
+// terminal is an interactive session's pty, which can outlive the SSH session it was created for (if it is
+// detached) and be reattached to a later session
+type terminal struct {
+	jail    *userJail
+	command string
+	started time.Time
+	// stopping is closed when the server is shutting down (when terminals can no longer be reattached)
+	stopping <-chan struct{}
+
+	ptmx *os.File
+	// tty is the path of the pty's slave end (for writing broadcast messages)
+	tty  string
+	proc *util.AgentProcess
+
+	lock       sync.Mutex
+	attached   ssh.Session
+	hangup     *time.Timer
+	scrollback *util.RingBuffer
+
+	outputDone chan struct{}
+	done       chan struct{}
+	exitCode   int
+	err        error
+}
+
+// newTerminal starts an interactive process in a jail attached to a session, taking over the session's reference to
+// the jail
+func (s *Server) newTerminal(sess ssh.Session, jail *userJail, req util.AgentRequest, command string,
+	window ssh.Window) (*terminal, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate pty: %w", err)
+	}
+	defer tty.Close()
+
+	if err := pty.Setsize(ptmx, util.SSHToPTYSize(window)); err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("failed to set pty size: %w", err)
+	}
+
+	proc, err := jail.Exec(req, tty, tty, tty)
+	if err != nil {
+		ptmx.Close()
+		return nil, fmt.Errorf("failed to start interactive command: %w", err)
+	}
+
+	t := &terminal{
+		jail:    jail,
+		command: command,
+		started: time.Now(),
+
+		stopping: s.stopping,
+
+		ptmx: ptmx,
+		tty:  tty.Name(),
+		proc: proc,
+
+		attached:   sess,
+		scrollback: util.NewRingBuffer(s.config.Sessions.Scrollback),
+
+		outputDone: make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	s.terminalsLock.Lock()
+	s.terminals[jail.User.Username] = append(s.terminals[jail.User.Username], t)
+	s.terminalsLock.Unlock()
+
+	if d := jail.config.SessionDuration; d > 0 {
+		limit := time.AfterFunc(d, func() {
+			s.audit("session_killed", log.Fields{
+				"user":    jail.User.Username,
+				"command": command,
+				"reason":  "session_duration",
+			})
+			t.expire()
+		})
+		go func() {
+			<-t.done
+			limit.Stop()
+		}()
+	}
+
+	go t.pumpOutput()
+	go func() {
+		t.exitCode, t.err = proc.Wait()
+		// Check for limits being hit now so the user finds out why before the session closes
+		jail.Usage()
+
+		// Give the output a chance to drain before hanging up the pty
+		select {
+		case <-t.outputDone:
+		case <-time.After(time.Second):
+		}
+		ptmx.Close()
+
+		t.lock.Lock()
+		if t.hangup != nil {
+			t.hangup.Stop()
+		}
+		t.lock.Unlock()
+		close(t.done)
+
+		s.removeTerminal(t)
+		s.releaseJail(jail)
+	}()
+
+	return t, nil
+}
+
+func (s *Server) removeTerminal(t *terminal) {
+	s.terminalsLock.Lock()
+	defer s.terminalsLock.Unlock()
+
+	username := t.jail.User.Username
+	ts := s.terminals[username]
+	for i, other := range ts {
+		if other == t {
+			ts = append(ts[:i], ts[i+1:]...)
+			break
+		}
+	}
+
+	if len(ts) == 0 {
+		delete(s.terminals, username)
+	} else {
+		s.terminals[username] = ts
+	}
+}
+
+// takeDetached finds the user's most recently started detached shell (if any) and attaches it to a session
+func (s *Server) takeDetached(username string, sess ssh.Session) *terminal {
+	s.terminalsLock.Lock()
+	defer s.terminalsLock.Unlock()
+
+	ts := s.terminals[username]
+	for i := len(ts) - 1; i >= 0; i-- {
+		// Terminals running a command are never detached, but may still be hanging up
+		if ts[i].command != "" {
+			continue
+		}
+		if ts[i].attach(sess) {
+			return ts[i]
+		}
+	}
+
+	return nil
+}
+
+func (t *terminal) pumpOutput() {
+	defer close(t.outputDone)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.ptmx.Read(buf)
+		if n > 0 {
+			// Write to the session outside the lock so a stalled client can't block attaching or detaching (a
+			// session attached after this point gets the output from the scrollback instead)
+			t.lock.Lock()
+			t.scrollback.Write(buf[:n])
+			sess := t.attached
+			t.lock.Unlock()
+
+			if sess != nil {
+				sess.Write(buf[:n])
+			}
+		}
+		if err != nil {
+			// EIO indicates all of the pty's slave fds have been closed
+			if !errors.Is(err, io.EOF) && !errors.Is(err, syscall.EIO) && !errors.Is(err, os.ErrClosed) {
+				log.WithError(err).Debug("Failed to read from pty")
+			}
+			return
+		}
+	}
+}
+
+// attach connects a session to the terminal (if the terminal is detached), replaying the scrollback
+func (t *terminal) attach(sess ssh.Session) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	if t.attached != nil {
+		return false
+	}
+
+	if t.hangup != nil {
+		t.hangup.Stop()
+		t.hangup = nil
+
+		fmt.Fprintf(sess, "[shh] Reattached to session started at %v\r\n", t.started.Format(time.RFC1123))
+		sess.Write(t.scrollback.Bytes())
+	}
+
+	t.attached = sess
+	return true
+}
+
+// hangUpDetached hangs up all terminals which aren't attached to a session
+func (s *Server) hangUpDetached() {
+	s.terminalsLock.Lock()
+	var detached []*terminal
+	for _, ts := range s.terminals {
+		for _, t := range ts {
+			t.lock.Lock()
+			if t.attached == nil {
+				detached = append(detached, t)
+			}
+			t.lock.Unlock()
+		}
+	}
+	s.terminalsLock.Unlock()
+
+	for _, t := range detached {
+		go t.hangUp()
+	}
+}
+
+// detach disconnects the terminal from its session, hanging up the terminal if it isn't reattached within grace
+func (t *terminal) detach(grace time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.attached = nil
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+
+	t.hangup = time.AfterFunc(grace, t.hangUp)
+}
+
+// hangUpProcess sends SIGHUP to a process, killing it if it hasn't exited (closed done) within hangupKillTimeout
+func hangUpProcess(l *log.Entry, proc *util.AgentProcess, done <-chan struct{}) {
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		l.WithError(err).Warn("Failed to send SIGHUP to process")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(hangupKillTimeout):
+		if err := proc.Signal(syscall.SIGKILL); err != nil {
+			l.WithError(err).Warn("Failed to kill process")
+		}
+	}
+}
+
+func (t *terminal) hangUp() {
+	l := log.WithField("user", t.jail.User.Username)
+	l.Debug("Hanging up detached terminal")
+
+	hangUpProcess(l, t.proc, t.done)
+}
+
+// expire hangs up the terminal once it reaches the session duration limit
+func (t *terminal) expire() {
+	l := log.WithField("user", t.jail.User.Username)
+	l.Info("Terminal reached session duration limit, hanging up")
+
+	t.lock.Lock()
+	sess := t.attached
+	t.lock.Unlock()
+	if sess != nil {
+		fmt.Fprintf(sess, "\r\n[shh] Session time limit reached, hanging up\r\n")
+	}
+
+	hangUpProcess(l, t.proc, t.done)
+}
+
+// run connects an SSH session to the terminal until either the process exits or the session is disconnected
+func (t *terminal) run(sess ssh.Session, window ssh.Window, resizeChan <-chan ssh.Window,
+	grace time.Duration) error {
+	pty.Setsize(t.ptmx, util.SSHToPTYSize(window))
+	go func() {
+		for resize := range resizeChan {
+			pty.Setsize(t.ptmx, util.SSHToPTYSize(resize))
+		}
+	}()
+
+	inputDone := make(chan struct{})
+	go func() {
+		io.Copy(t.ptmx, sess)
+		close(inputDone)
+	}()
+
+	sigChan := make(chan ssh.Signal)
+	sess.Signals(sigChan)
+	go func() {
+		for s := range sigChan {
+			log.WithFields(log.Fields{
+				"signal": s,
+			}).Trace("Forwarding signal")
+			t.proc.Signal(util.SSHSignalToOS(s))
+		}
+	}()
+
+	select {
+	case <-t.done:
+	case <-sess.Context().Done():
+	case <-inputDone:
+	}
+
+	select {
+	case <-t.done:
+		if t.err != nil {
+			return fmt.Errorf("command failed: %w", t.err)
+		}
+		if t.exitCode != 0 {
+			sess.Exit(t.exitCode)
+		}
+
+		return nil
+	default:
+	}
+
+	select {
+	case <-t.stopping:
+		grace = 0
+	default:
+	}
+	if t.command != "" {
+		// Only shells are reattached to (a plain login shouldn't end up in someone's command)
+		grace = 0
+	}
+	if grace > 0 {
+		log.WithFields(log.Fields{
+			"user":  t.jail.User.Username,
+			"grace": grace,
+		}).Info("Session disconnected, detaching terminal")
+	}
+	t.detach(grace)
+
+	return nil
+}
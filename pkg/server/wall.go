@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// wallTimeout is the maximum time to wait for a terminal to accept a broadcast message
+const wallTimeout = time.Second
+
+// wall writes a message to the terminal's tty (as wall(1) does), so it appears in the output stream like any other
+// output from the user's programs (and in the scrollback if the terminal is detached)
+func (t *terminal) wall(msg string) error {
+	select {
+	case <-t.done:
+		return errors.New("terminal closed")
+	default:
+	}
+
+	f, err := os.OpenFile(t.tty, os.O_WRONLY|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open tty: %w", err)
+	}
+	defer f.Close()
+
+	if err := f.SetWriteDeadline(time.Now().Add(wallTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+	if _, err := f.WriteString(msg); err != nil {
+		return fmt.Errorf("failed to write to tty: %w", err)
+	}
+
+	return nil
+}
+
+// broadcastBanner formats a broadcast message for terminals
+func broadcastBanner(from, msg string) string {
+	msg = strings.ReplaceAll(strings.TrimSpace(msg), "\n", "\r\n")
+	return fmt.Sprintf("\r\n\r\nBroadcast message from %v (%v):\r\n\r\n%v\r\n\r\n", from,
+		time.Now().Format(time.RFC1123), msg)
+}
+
+// broadcast writes a message from an administrator to all terminals (including detached ones), returning the number
+// of terminals it was written to
+func (s *Server) broadcast(from, msg string) int {
+	log.WithField("from", from).Info("Broadcasting message")
+	s.audit("broadcast", log.Fields{
+		"from":    from,
+		"message": msg,
+	})
+
+	s.terminalsLock.Lock()
+	var terminals []*terminal
+	for _, ts := range s.terminals {
+		terminals = append(terminals, ts...)
+	}
+	s.terminalsLock.Unlock()
+
+	banner := broadcastBanner(from, msg)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	n := 0
+	for _, t := range terminals {
+		wg.Add(1)
+		go func(t *terminal) {
+			defer wg.Done()
+
+			if err := t.wall(banner); err != nil {
+				log.WithError(err).WithField("user", t.jail.User.Username).Debug("Failed to write broadcast message")
+				return
+			}
+
+			lock.Lock()
+			n++
+			lock.Unlock()
+		}(t)
+	}
+	wg.Wait()
+
+	return n
+}
+
+// BroadcastFile broadcasts the contents of the broadcast message file to all terminals
+func (s *Server) BroadcastFile() error {
+	file := s.config.Sessions.BroadcastFile
+	if file == "" {
+		file = path.Join(s.config.StateDir, "broadcast")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read broadcast message file: %w", err)
+	}
+
+	msg := strings.TrimSpace(string(data))
+	if msg == "" {
+		return errors.New("broadcast message file is empty")
+	}
+
+	n := s.broadcast("shhd", msg)
+	log.WithFields(log.Fields{
+		"file":      file,
+		"terminals": n,
+	}).Info("Broadcast message from file")
+	return nil
+}
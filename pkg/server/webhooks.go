@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhook events
+const (
+	// webhookAuthFailures is sent when an address fails password authentication repeatedly
+	webhookAuthFailures = "auth_failures"
+	// webhookNewAddress is sent when a user logs in from an address they haven't used before
+	webhookNewAddress = "new_address"
+	// webhookLimit is sent when a jail hits a resource limit
+	webhookLimit = "limit"
+	// webhookSessionKilled is sent when shhd terminates a session
+	webhookSessionKilled = "session_killed"
+)
+
+// webhookRetryDelay is the delay before the first retry of a failed delivery (doubling for each further attempt)
+const webhookRetryDelay = time.Second
+
+// Webhook is an endpoint which security-relevant events are POSTed to
+type Webhook struct {
+	URL string
+	// Secret is used to sign payloads (with HMAC-SHA256, in the X-Shh-Signature header)
+	Secret     string
+	SecretFile string `mapstructure:"secret_file"`
+	// Events is the list of events to send (all events if empty)
+	Events []string
+}
+
+func (w *Webhook) wants(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload is the JSON body of a webhook request
+type webhookPayload struct {
+	Event string                 `json:"event"`
+	Time  time.Time              `json:"time"`
+	Data  map[string]interface{} `json:"data"`
+}
+
+type webhookDelivery struct {
+	hook *Webhook
+	body []byte
+}
+
+// webhooks detects suspicious activity from audit events and reports it to webhooks
+type webhooks struct {
+	s      *Server
+	client *http.Client
+	known  *knownAddresses
+
+	queue chan webhookDelivery
+	stop  chan struct{}
+	done  chan struct{}
+
+	lock sync.Mutex
+	// failures are the times of recent password authentication failures by address
+	failures map[string][]time.Time
+}
+
+func newWebhooks(s *Server) (*webhooks, error) {
+	known, err := loadKnownAddresses(path.Join(s.config.StateDir, "addresses.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhooks{
+		s:      s,
+		client: &http.Client{Timeout: s.config.Webhooks.Timeout},
+		known:  known,
+
+		queue: make(chan webhookDelivery, s.config.Webhooks.QueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+
+		failures: make(map[string][]time.Time),
+	}, nil
+}
+
+// run delivers queued webhooks until shutdown() is called
+func (w *webhooks) run() {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case d := <-w.queue:
+			w.deliver(d)
+		}
+	}
+}
+
+func (w *webhooks) shutdown() {
+	close(w.stop)
+	<-w.done
+}
+
+// deliver POSTs a payload to a webhook, retrying with exponential backoff
+func (w *webhooks) deliver(d webhookDelivery) {
+	l := log.WithField("url", d.hook.URL)
+
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := w.post(d)
+		if err == nil {
+			return
+		}
+		if attempt >= w.s.config.Webhooks.Retries {
+			l.WithError(err).Error("Failed to deliver webhook, giving up")
+			return
+		}
+
+		l.WithError(err).WithField("attempt", attempt+1).Warn("Failed to deliver webhook, retrying")
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (w *webhooks) post(d webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(d.hook.Secret))
+		mac.Write(d.body)
+		req.Header.Set("X-Shh-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("got status %v", res.Status)
+	}
+	return nil
+}
+
+// send queues an event for delivery to all webhooks which want it, dropping it if the queue is full
+func (w *webhooks) send(event string, data map[string]interface{}) {
+	body, err := json.Marshal(webhookPayload{
+		Event: event,
+		Time:  time.Now(),
+		Data:  data,
+	})
+	if err != nil {
+		log.WithError(err).WithField("event", event).Error("Failed to encode webhook payload")
+		return
+	}
+
+	for i := range w.s.config.Webhooks.Endpoints {
+		hook := &w.s.config.Webhooks.Endpoints[i]
+		if !hook.wants(event) {
+			continue
+		}
+
+		select {
+		case w.queue <- webhookDelivery{hook, body}:
+		default:
+			log.WithFields(log.Fields{
+				"event": event,
+				"url":   hook.URL,
+			}).Warn("Webhook queue full, dropping event")
+		}
+	}
+}
+
+// authFailed records a password authentication failure at a given time, returning the number of recent failures if
+// the threshold has been reached
+func (w *webhooks) authFailed(address string, now time.Time) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	window := w.s.config.Webhooks.AuthFailures.Window
+	for a, times := range w.failures {
+		if now.Sub(times[len(times)-1]) >= window {
+			delete(w.failures, a)
+		}
+	}
+
+	recent := w.failures[address][:0]
+	for _, t := range w.failures[address] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < w.s.config.Webhooks.AuthFailures.Threshold {
+		w.failures[address] = recent
+		return 0
+	}
+
+	// Start counting again so a sustained attack is reported once per threshold failures
+	delete(w.failures, address)
+	return len(recent)
+}
+
+// handle checks an audit event for activity to report
+func (w *webhooks) handle(event string, fields log.Fields) {
+	switch event {
+	case "auth":
+		address := fields["address"].(string)
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+
+		if !fields["success"].(bool) {
+			// Clients commonly offer several public keys, so only password failures are counted
+			if fields["method"] != "password" {
+				return
+			}
+
+			if n := w.authFailed(address, time.Now()); n > 0 {
+				w.send(webhookAuthFailures, map[string]interface{}{
+					"address":  address,
+					"user":     fields["user"],
+					"failures": n,
+					"window":   w.s.config.Webhooks.AuthFailures.Window.Seconds(),
+				})
+			}
+			return
+		}
+
+		username := fields["user"].(string)
+		if m := regexDirectLogin.FindStringSubmatch(username); len(m) > 0 {
+			username = m[1]
+		}
+
+		isNew, err := w.known.add(username, address)
+		if err != nil {
+			log.WithError(err).Warn("Failed to save known addresses")
+		}
+		if isNew {
+			w.send(webhookNewAddress, map[string]interface{}{
+				"user":    username,
+				"address": address,
+				"method":  fields["method"],
+			})
+		}
+	case "limit":
+		w.send(webhookLimit, fields)
+	case "session_killed":
+		// Every session is terminated when the server stops, which isn't worth notifying about
+		if fields["reason"] != "shutdown" {
+			w.send(webhookSessionKilled, fields)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testWebhooks(threshold int, window time.Duration) *webhooks {
+	s := &Server{}
+	s.config.Webhooks.AuthFailures.Threshold = threshold
+	s.config.Webhooks.AuthFailures.Window = window
+
+	return &webhooks{
+		s:        s,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		failures: make(map[string][]time.Time),
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	type failure struct {
+		address string
+		at      time.Duration
+		want    int
+	}
+
+	tests := []struct {
+		name     string
+		failures []failure
+	}{
+		{
+			name:     "below threshold",
+			failures: []failure{{"10.0.0.1", 0, 0}, {"10.0.0.1", time.Minute, 0}},
+		},
+		{
+			name: "threshold reached",
+			failures: []failure{
+				{"10.0.0.1", 0, 0},
+				{"10.0.0.1", time.Minute, 0},
+				{"10.0.0.1", 2 * time.Minute, 3},
+			},
+		},
+		{
+			name: "counting restarts after a report",
+			failures: []failure{
+				{"10.0.0.1", 0, 0},
+				{"10.0.0.1", time.Second, 0},
+				{"10.0.0.1", 2 * time.Second, 3},
+				{"10.0.0.1", 3 * time.Second, 0},
+				{"10.0.0.1", 4 * time.Second, 0},
+				{"10.0.0.1", 5 * time.Second, 3},
+			},
+		},
+		{
+			name: "old failures expire",
+			failures: []failure{
+				{"10.0.0.1", 0, 0},
+				{"10.0.0.1", 5 * time.Minute, 0},
+				{"10.0.0.1", 10 * time.Minute, 0},
+				{"10.0.0.1", 11 * time.Minute, 3},
+			},
+		},
+		{
+			name: "addresses are counted separately",
+			failures: []failure{
+				{"10.0.0.1", 0, 0},
+				{"10.0.0.2", time.Second, 0},
+				{"10.0.0.1", 2 * time.Second, 0},
+				{"10.0.0.2", 3 * time.Second, 0},
+				{"10.0.0.1", 4 * time.Second, 3},
+				{"10.0.0.2", 5 * time.Second, 3},
+			},
+		},
+	}
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testWebhooks(3, 10*time.Minute)
+			for i, f := range tt.failures {
+				if got := w.authFailed(f.address, start.Add(f.at)); got != f.want {
+					t.Errorf("failure %v (%v at %v) = %v, want %v", i, f.address, f.at, got, f.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthFailedForgetsIdleAddresses(t *testing.T) {
+	w := testWebhooks(3, 10*time.Minute)
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	w.authFailed("10.0.0.1", start)
+	w.authFailed("10.0.0.2", start.Add(5*time.Minute))
+	w.authFailed("10.0.0.3", start.Add(12*time.Minute))
+
+	if _, ok := w.failures["10.0.0.1"]; ok || len(w.failures) != 2 {
+		t.Errorf("failures = %v, want only 10.0.0.2 and 10.0.0.3", w.failures)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// Test vector from https://en.wikipedia.org/wiki/HMAC#Examples
+	const body = "The quick brown fox jumps over the lazy dog"
+
+	tests := []struct {
+		name      string
+		secret    string
+		status    int
+		signature string
+		wantErr   bool
+	}{
+		{
+			name:      "signed",
+			secret:    "key",
+			status:    http.StatusOK,
+			signature: "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		},
+		{
+			name:   "unsigned",
+			status: http.StatusNoContent,
+		},
+		{
+			name:      "error status",
+			secret:    "key",
+			status:    http.StatusInternalServerError,
+			signature: "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			var reqBody []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				req = r
+				reqBody, _ = io.ReadAll(r.Body)
+				rw.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			w := testWebhooks(1, time.Minute)
+			err := w.post(webhookDelivery{&Webhook{URL: srv.URL, Secret: tt.secret}, []byte(body)})
+			if tt.wantErr != (err != nil) {
+				t.Errorf("post() = %v, want error %v", err, tt.wantErr)
+			}
+
+			if req == nil {
+				t.Fatal("webhook wasn't delivered")
+			}
+			if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("got %v request with content type %q", req.Method, req.Header.Get("Content-Type"))
+			}
+			if string(reqBody) != body {
+				t.Errorf("body = %q, want %q", reqBody, body)
+			}
+
+			sig, ok := req.Header["X-Shh-Signature"]
+			if tt.signature == "" {
+				if ok {
+					t.Errorf("unsigned webhook has signature %q", sig)
+				}
+			} else if req.Header.Get("X-Shh-Signature") != tt.signature {
+				t.Errorf("signature = %q, want %q", req.Header.Get("X-Shh-Signature"), tt.signature)
+			}
+		})
+	}
+}
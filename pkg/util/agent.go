@@ -0,0 +1,351 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// AgentCommand is the (hidden) shhd subcommand used to run the agent inside a jail
+const AgentCommand = "jail-agent"
+
+const agentMaxMessage = 64 * 1024
+
+// AgentRequest is sent to a jail's agent to start a process, along with the process' stdin, stdout and stderr
+type AgentRequest struct {
+	Argv []string
+	Env  []string
+	// TTY indicates that the provided stdio is a pty slave which should become the process' controlling terminal
+	TTY bool
+}
+
+// LoginArgv returns the command line the agent runs for a session: a login shell for the user, which runs command if
+// it isn't empty
+func LoginArgv(username, command string) []string {
+	argv := []string{"/bin/su", "-", username}
+	if command != "" {
+		argv = append(argv, "-c", command)
+	}
+
+	return argv
+}
+
+// agentMessage is exchanged between shhd and the agent while a process is running
+type agentMessage struct {
+	Signal   int  `json:",omitempty"`
+	Exited   bool `json:",omitempty"`
+	ExitCode int
+	Error    string `json:",omitempty"`
+}
+
+// RunJailAgent runs the in-jail agent, which starts processes on behalf of shhd inside the jail
+func RunJailAgent(socket string) error {
+	if os.Getpid() == 1 {
+		return runAgentInit()
+	}
+
+	os.Remove(socket)
+	l, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: socket, Net: "unixpacket"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on agent socket: %w", err)
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return fmt.Errorf("failed to accept agent connection: %w", err)
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleAgentConn(conn); err != nil {
+				fmt.Fprintf(os.Stderr, "agent: %v\n", err)
+			}
+		}()
+	}
+}
+
+// runAgentInit runs the agent as a child process and reaps any orphaned processes in the jail (as PID 1)
+func runAgentInit() error {
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start agent: %w", err)
+	}
+
+	for {
+		var ws unix.WaitStatus
+		pid, err := unix.Wait4(-1, &ws, 0, nil)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+
+			return fmt.Errorf("failed to wait for children: %w", err)
+		}
+
+		if pid == cmd.Process.Pid {
+			return fmt.Errorf("agent exited with status %v", ws.ExitStatus())
+		}
+	}
+}
+
+func writeAgentMessage(conn *net.UnixConn, m agentMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(data)
+	return err
+}
+
+func readAgentMessage(conn *net.UnixConn) (agentMessage, error) {
+	var m agentMessage
+	buf := make([]byte, agentMaxMessage)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return m, err
+	}
+	if n == 0 {
+		return m, io.EOF
+	}
+
+	err = json.Unmarshal(buf[:n], &m)
+	return m, err
+}
+
+func exitCode(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+
+	return ps.ExitCode()
+}
+
+func handleAgentConn(conn *net.UnixConn) error {
+	buf := make([]byte, agentMaxMessage)
+	oob := make([]byte, unix.CmsgSpace(3*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if errors.Is(err, io.EOF) || (err == nil && n == 0) {
+		// Connection was just a probe (see AgentPID())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read request: %w", err)
+	}
+
+	var fds []int
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return fmt.Errorf("failed to parse control message: %w", err)
+	}
+	for _, m := range msgs {
+		f, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			return fmt.Errorf("failed to parse passed file descriptors: %w", err)
+		}
+		fds = append(fds, f...)
+	}
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		files[i] = os.NewFile(uintptr(fd), fmt.Sprintf("fd%v", i))
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var req AgentRequest
+	if err := json.Unmarshal(buf[:n], &req); err != nil {
+		return fmt.Errorf("failed to decode request: %w", err)
+	}
+	if len(req.Argv) == 0 {
+		return writeAgentMessage(conn, agentMessage{Exited: true, ExitCode: -1, Error: "empty command"})
+	}
+	if len(files) != 3 {
+		return writeAgentMessage(conn, agentMessage{Exited: true, ExitCode: -1, Error: "expected 3 file descriptors"})
+	}
+
+	cmd := exec.Command(req.Argv[0], req.Argv[1:]...)
+	cmd.Env = req.Env
+	cmd.Stdin = files[0]
+	cmd.Stdout = files[1]
+	cmd.Stderr = files[2]
+	if req.TTY {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+			Ctty:    0,
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return writeAgentMessage(conn, agentMessage{Exited: true, ExitCode: -1, Error: err.Error()})
+	}
+	for _, f := range files {
+		f.Close()
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		for {
+			m, err := readAgentMessage(conn)
+			if err != nil {
+				// shhd went away, treat it like a hangup
+				select {
+				case <-exited:
+				default:
+					cmd.Process.Signal(syscall.SIGHUP)
+				}
+				return
+			}
+
+			if m.Signal != 0 {
+				cmd.Process.Signal(syscall.Signal(m.Signal))
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	close(exited)
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return writeAgentMessage(conn, agentMessage{Exited: true, ExitCode: -1, Error: err.Error()})
+	}
+
+	return writeAgentMessage(conn, agentMessage{Exited: true, ExitCode: exitCode(cmd.ProcessState)})
+}
+
+// dialAgent connects to the agent listening on socket, returning the connection and the PID of the process which
+// created the socket (as seen by the caller)
+func dialAgent(socket string) (*net.UnixConn, int, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: socket, Net: "unixpacket"})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to connect to agent: %w", err)
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("failed to get raw connection: %w", err)
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if credErr != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("failed to get agent credentials: %w", credErr)
+	}
+
+	return conn, int(cred.Pid), nil
+}
+
+// AgentPID returns the PID of the agent listening on socket (as seen by the caller)
+func AgentPID(socket string) (int, error) {
+	conn, pid, err := dialAgent(socket)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+
+	return pid, nil
+}
+
+// parentPID returns the PID of a process' parent
+func parentPID(pid int) (int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%v/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name (in parentheses) can contain spaces, the state and parent PID follow it
+	fields := strings.Fields(string(data[bytes.LastIndexByte(data, ')')+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("invalid stat for process %v", pid)
+	}
+
+	return strconv.Atoi(fields[1])
+}
+
+// AgentProcess represents a process started by a jail's agent
+type AgentProcess struct {
+	conn *net.UnixConn
+}
+
+// ExecAgent asks the agent listening on socket to start a process with the given stdin, stdout and stderr. Nothing
+// is sent unless the socket was created by the process with the given PID (see AgentPID()).
+func ExecAgent(socket string, pid int, req AgentRequest, stdin, stdout, stderr *os.File) (*AgentProcess, error) {
+	conn, peer, err := dialAgent(socket)
+	if err != nil {
+		return nil, err
+	}
+	if peer != pid {
+		conn.Close()
+		return nil, fmt.Errorf("agent socket belongs to process %v instead of the agent (%v)", peer, pid)
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	rights := unix.UnixRights(int(stdin.Fd()), int(stdout.Fd()), int(stderr.Fd()))
+	if _, _, err := conn.WriteMsgUnix(data, rights, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	return &AgentProcess{conn}, nil
+}
+
+// Signal sends a signal to the process
+func (p *AgentProcess) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+
+	return writeAgentMessage(p.conn, agentMessage{Signal: int(s)})
+}
+
+// Wait waits for the process to exit and returns its exit code
+func (p *AgentProcess) Wait() (int, error) {
+	defer p.conn.Close()
+
+	for {
+		m, err := readAgentMessage(p.conn)
+		if err != nil {
+			return -1, fmt.Errorf("failed to read from agent: %w", err)
+		}
+		if !m.Exited {
+			continue
+		}
+
+		if m.Error != "" {
+			return m.ExitCode, errors.New(m.Error)
+		}
+		return m.ExitCode, nil
+	}
+}
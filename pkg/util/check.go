@@ -0,0 +1,123 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+
+	iam "github.com/netsoc/iam/client"
+)
+
+// CheckJailConfig validates a jail config (and loads the mounts and seccomp policy derived from it) without setting
+// anything up on the host. If nsjail is false, the seccomp policy is generated but not validated by nsjail.
+func CheckJailConfig(c *JailConfig, nsjail bool) error {
+	if _, ok := nsjailLogLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("unknown nsjail log level %v", c.LogLevel)
+	}
+	if _, err := c.ShellPath(c.Shell); err != nil {
+		return fmt.Errorf("invalid default shell: %w", err)
+	}
+	if err := checkProfiles(c); err != nil {
+		return fmt.Errorf("invalid profile configuration: %w", err)
+	}
+	if err := initMounts(c); err != nil {
+		return fmt.Errorf("invalid mount configuration: %w", err)
+	}
+
+	if nsjail {
+		if err := initSeccomp(c); err != nil {
+			return fmt.Errorf("invalid seccomp configuration: %w", err)
+		}
+	} else {
+		policy, err := c.Seccomp.policy()
+		if err != nil {
+			return fmt.Errorf("invalid seccomp configuration: %w", err)
+		}
+		seccompPolicy = policy
+	}
+
+	if err := checkHomeConfig(c); err != nil {
+		return fmt.Errorf("invalid home configuration: %w", err)
+	}
+	if err := checkNetworkConfig(c); err != nil {
+		return fmt.Errorf("invalid network configuration: %w", err)
+	}
+
+	return nil
+}
+
+// checkNetwork checks that a jail network's gateway address is a usable host address
+func checkNetwork(n net.IPNet, v6 bool) error {
+	if n.IP == nil {
+		return errors.New("address is not set")
+	}
+	if v6 && n.IP.To4() != nil {
+		return fmt.Errorf("%v is not an IPv6 address", n.IP)
+	}
+	if !v6 && n.IP.To4() == nil {
+		return fmt.Errorf("%v is not an IPv4 address", n.IP)
+	}
+
+	ones, bits := n.Mask.Size()
+	if bits == 0 {
+		return fmt.Errorf("invalid netmask %v", n.Mask)
+	}
+	// The gateway and at least one jail need addresses
+	if bits-ones < 2 {
+		return fmt.Errorf("network %v is too small", n.String())
+	}
+	if n.IP.Equal(n.IP.Mask(n.Mask)) {
+		return fmt.Errorf("%v is the network address", n.IP)
+	}
+
+	return nil
+}
+
+func checkNetworkConfig(c *JailConfig) error {
+	if c.Network.Interface == "" {
+		return nil
+	}
+
+	if err := checkNetwork(c.Network.Address, false); err != nil {
+		return fmt.Errorf("address: %w", err)
+	}
+	if c.Network.Address6.IP != nil {
+		if err := checkNetwork(c.Network.Address6, true); err != nil {
+			return fmt.Errorf("address6: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RenderJail generates the nsjail config which StartJail() would use for a user's jail (c must have been checked
+// with CheckJailConfig() or InitJail())
+func RenderJail(c *JailConfig, u *iam.User, opts JailOptions) ([]byte, error) {
+	if err := checkUsername(u.Username); err != nil {
+		return nil, err
+	}
+
+	agent, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shhd executable path: %w", err)
+	}
+	if opts.Home == "" && c.Home.Backend == HomeBackendImage {
+		opts.Home = homeDir(c, u)
+	}
+
+	// The real directory has a random suffix
+	dir := path.Join(c.TmpDir, "jails", u.Username+"-XXXXXX")
+	info, err := newJailInfo(c, u, dir, agent, opts, false)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := info.nsjailConfig().marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nsjail config: %w", err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hostResolvConf is the host's resolver configuration, used if no nameservers are configured
+var hostResolvConf = "/etc/resolv.conf"
+
+// DNSConfig represents the resolver configuration for jails
+type DNSConfig struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+}
+
+// HostsEntry represents a static /etc/hosts entry for jails
+type HostsEntry struct {
+	IP        string
+	Hostnames []string
+}
+
+// resolvConf is the effective resolver configuration (either configured or taken from the host)
+var resolvConf DNSConfig
+
+// parseResolvConf reads the resolver configuration from a resolv.conf file
+func parseResolvConf(file string) (DNSConfig, error) {
+	var d DNSConfig
+
+	f, err := os.Open(file)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			d.Nameservers = append(d.Nameservers, fields[1])
+		case "domain", "search":
+			d.Search = fields[1:]
+		case "options":
+			d.Options = append(d.Options, fields[1:]...)
+		}
+	}
+
+	return d, s.Err()
+}
+
+func initDNS(c *JailConfig) error {
+	d := c.DNS
+	if len(d.Nameservers) == 0 {
+		host, err := parseResolvConf(hostResolvConf)
+		if err != nil {
+			return fmt.Errorf("failed to read host resolver configuration: %w", err)
+		}
+
+		// Loopback resolvers (e.g. systemd-resolved's 127.0.0.53) aren't reachable from inside a jail's network namespace
+		for _, ns := range host.Nameservers {
+			if ip := net.ParseIP(ns); ip != nil && ip.IsLoopback() {
+				log.WithField("nameserver", ns).Warn("Ignoring loopback nameserver from host resolver configuration")
+				continue
+			}
+			d.Nameservers = append(d.Nameservers, ns)
+		}
+		if len(d.Nameservers) == 0 {
+			return fmt.Errorf("no usable nameservers in %v (loopback resolvers can't be reached from jails), "+
+				"set jail.dns.nameservers", hostResolvConf)
+		}
+
+		if len(d.Search) == 0 {
+			d.Search = host.Search
+		}
+		if len(d.Options) == 0 {
+			d.Options = host.Options
+		}
+	}
+
+	for _, ns := range d.Nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil {
+			return fmt.Errorf("invalid nameserver %v", ns)
+		}
+		if ip.IsLoopback() {
+			return fmt.Errorf("loopback nameserver %v can't be reached from jails", ns)
+		}
+	}
+	for _, h := range c.Hosts {
+		if net.ParseIP(h.IP) == nil {
+			return fmt.Errorf("invalid IP %v for hosts entry", h.IP)
+		}
+		for _, n := range h.Hostnames {
+			if n == "" || strings.ContainsAny(n, " \t\n#") {
+				return fmt.Errorf("invalid hostname %q for hosts entry", n)
+			}
+		}
+	}
+
+	resolvConf = d
+	return nil
+}
+
+func renderResolvConf() []byte {
+	var b bytes.Buffer
+	for _, ns := range resolvConf.Nameservers {
+		fmt.Fprintf(&b, "nameserver %v\n", ns)
+	}
+	if len(resolvConf.Search) != 0 {
+		fmt.Fprintf(&b, "search %v\n", strings.Join(resolvConf.Search, " "))
+	}
+	if len(resolvConf.Options) != 0 {
+		fmt.Fprintf(&b, "options %v\n", strings.Join(resolvConf.Options, " "))
+	}
+
+	return b.Bytes()
+}
+
+func renderHosts(c *JailConfig, hostname string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "127.0.0.1\tlocalhost\n")
+	fmt.Fprintf(&b, "::1\tlocalhost\n")
+	fmt.Fprintf(&b, "127.0.1.1\t%v\n", hostname)
+	for _, h := range c.Hosts {
+		fmt.Fprintf(&b, "%v\t%v\n", h.IP, strings.Join(h.Hostnames, " "))
+	}
+
+	return b.Bytes()
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want DNSConfig
+	}{
+		{"empty", "", DNSConfig{}},
+		{
+			name: "typical",
+			data: "# Generated by NetworkManager\nsearch netsoc.ie example.com\nnameserver 1.1.1.1\nnameserver 2606:4700:4700::1111\noptions ndots:5 timeout:2\n",
+			want: DNSConfig{
+				Nameservers: []string{"1.1.1.1", "2606:4700:4700::1111"},
+				Search:      []string{"netsoc.ie", "example.com"},
+				Options:     []string{"ndots:5", "timeout:2"},
+			},
+		},
+		{
+			name: "comments and malformed lines",
+			data: "; nameserver 8.8.8.8\n#nameserver 8.8.4.4\nnameserver\n\n  nameserver\t9.9.9.9  \nsortlist 10.0.0.0\n",
+			want: DNSConfig{Nameservers: []string{"9.9.9.9"}},
+		},
+		{
+			name: "last domain or search wins",
+			data: "search a.example b.example\ndomain c.example\n",
+			want: DNSConfig{Search: []string{"c.example"}},
+		},
+		{
+			name: "options accumulate",
+			data: "options ndots:1\noptions rotate edns0\n",
+			want: DNSConfig{Options: []string{"ndots:1", "rotate", "edns0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "resolv.conf")
+			if err := os.WriteFile(file, []byte(tt.data), 0o644); err != nil {
+				t.Fatalf("failed to write %v: %v", file, err)
+			}
+
+			got, err := parseResolvConf(file)
+			if err != nil {
+				t.Fatalf("parseResolvConf() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseResolvConf() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseResolvConfMissing(t *testing.T) {
+	if _, err := parseResolvConf(filepath.Join(t.TempDir(), "resolv.conf")); !os.IsNotExist(err) {
+		t.Errorf("parseResolvConf() = %v for a missing file, want a not exist error", err)
+	}
+}
+
+func TestInitDNS(t *testing.T) {
+	prevHostResolvConf, prevResolvConf := hostResolvConf, resolvConf
+	defer func() { hostResolvConf, resolvConf = prevHostResolvConf, prevResolvConf }()
+
+	tests := []struct {
+		name        string
+		host        string
+		nameservers []string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:        "configured",
+			host:        "nameserver 9.9.9.9\n",
+			nameservers: []string{"1.1.1.1"},
+			want:        []string{"1.1.1.1"},
+		},
+		{
+			name: "from host",
+			host: "nameserver 9.9.9.9\nnameserver 2620:fe::fe\n",
+			want: []string{"9.9.9.9", "2620:fe::fe"},
+		},
+		{
+			name: "host loopback resolvers dropped",
+			host: "nameserver 127.0.0.53\nnameserver 9.9.9.9\nnameserver ::1\n",
+			want: []string{"9.9.9.9"},
+		},
+		{
+			name:    "only host loopback resolvers",
+			host:    "nameserver 127.0.0.53\noptions edns0 trust-ad\n",
+			wantErr: true,
+		},
+		{
+			name:        "configured loopback resolver",
+			nameservers: []string{"1.1.1.1", "127.0.0.1"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid nameserver",
+			nameservers: []string{"one.one.one.one"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostResolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+			if err := os.WriteFile(hostResolvConf, []byte(tt.host), 0o644); err != nil {
+				t.Fatalf("failed to write %v: %v", hostResolvConf, err)
+			}
+			resolvConf = DNSConfig{}
+
+			c := &JailConfig{}
+			c.DNS.Nameservers = tt.nameservers
+			err := initDNS(c)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("initDNS() selected nameservers %v, want error", resolvConf.Nameservers)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("initDNS() failed: %v", err)
+			}
+			if !reflect.DeepEqual(resolvConf.Nameservers, tt.want) {
+				t.Errorf("nameservers = %v, want %v", resolvConf.Nameservers, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FirewallRule allows egress traffic from jails to a destination
+type FirewallRule struct {
+	// Destination is a CIDR, IP address or hostname (resolved when the firewall is reconciled). Empty means any.
+	Destination string
+	// Protocol is tcp, udp or empty for any
+	Protocol string
+	Ports    []uint16
+}
+
+// FirewallConfig represents the jail egress firewall configuration
+type FirewallConfig struct {
+	Table string
+	// Default is the action (accept or drop) for traffic not matching any rule
+	Default string
+	// Allow rules with a destination take precedence over Block, the rest are evaluated after it
+	Allow []FirewallRule
+	// Block lists CIDRs which jails may not access (e.g. cluster-internal ranges)
+	Block []string
+}
+
+func (r FirewallRule) match() (string, error) {
+	var parts []string
+
+	switch r.Protocol {
+	case "":
+		if len(r.Ports) != 0 {
+			return "", errors.New("protocol must be set to match ports")
+		}
+	case "tcp", "udp":
+		if len(r.Ports) == 0 {
+			parts = append(parts, "meta l4proto "+r.Protocol)
+		} else {
+			ports := make([]string, len(r.Ports))
+			for i, p := range r.Ports {
+				ports[i] = strconv.Itoa(int(p))
+			}
+			parts = append(parts, fmt.Sprintf("%v dport { %v }", r.Protocol, strings.Join(ports, ", ")))
+		}
+	default:
+		return "", fmt.Errorf("unknown protocol %v", r.Protocol)
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// resolveDestination parses a rule destination into a list of CIDRs
+func resolveDestination(dst string) ([]string, error) {
+	if _, n, err := net.ParseCIDR(dst); err == nil {
+		return []string{n.String()}, nil
+	}
+	if ip := net.ParseIP(dst); ip != nil {
+		return []string{ip.String()}, nil
+	}
+
+	ips, err := net.LookupIP(dst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %v: %w", dst, err)
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// addrFamily returns the nft address match keyword for a CIDR or IP address
+func addrFamily(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "ip6"
+	}
+
+	return "ip"
+}
+
+// daddrMatches groups addresses into one nft daddr match per family
+func daddrMatches(addrs []string) []string {
+	byFamily := map[string][]string{}
+	var families []string
+	for _, a := range addrs {
+		f := addrFamily(a)
+		if _, ok := byFamily[f]; !ok {
+			families = append(families, f)
+		}
+		byFamily[f] = append(byFamily[f], a)
+	}
+
+	matches := make([]string, len(families))
+	for i, f := range families {
+		matches[i] = fmt.Sprintf("%v daddr { %v }", f, strings.Join(byFamily[f], ", "))
+	}
+	return matches
+}
+
+// firewallMembers tracks the addresses of jails whose profile has its own firewall policy (by profile name), so
+// they can be restored when the table is replaced
+var firewallMembers = struct {
+	sync.Mutex
+	addrs map[string]map[string]struct{}
+}{addrs: make(map[string]map[string]struct{})}
+
+// profileChain returns the name of the chain (and the prefix of the sets) for a profile
+func profileChain(profile string) string {
+	return "profile_" + profile
+}
+
+// profileSet returns the name of the set holding the addresses of a profile's jails for an address family
+func profileSet(profile, family string) string {
+	if family == "ip6" {
+		return profileChain(profile) + "_v6"
+	}
+
+	return profileChain(profile) + "_v4"
+}
+
+// allowRules renders allow rules, split into those with a destination and those without
+func allowRules(rules []FirewallRule) ([]string, []string, error) {
+	var dst, anyDst []string
+	for _, r := range rules {
+		match, err := r.match()
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid rule for %v: %w", r.Destination, err)
+		}
+
+		if r.Destination == "" {
+			anyDst = append(anyDst, strings.TrimSpace(match+" accept"))
+			continue
+		}
+
+		addrs, err := resolveDestination(r.Destination)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range daddrMatches(addrs) {
+			dst = append(dst, strings.TrimSpace(d+" "+match)+" accept")
+		}
+	}
+
+	return dst, anyDst, nil
+}
+
+// firewallRuleset renders the nftables ruleset for the jail network (firewallMembers must be locked)
+func firewallRuleset(c *JailConfig) (string, error) {
+	fw := &c.Network.Firewall
+	if fw.Default != "accept" && fw.Default != "drop" {
+		return "", fmt.Errorf("unknown default action %v", fw.Default)
+	}
+
+	hostVeth := strconv.Quote(c.Network.Interface + "-host")
+	egress, egressAny, err := allowRules(fw.Allow)
+	if err != nil {
+		return "", err
+	}
+
+	// Jails using a profile with its own policy jump to the profile's chains (before blocked ranges for rules with a
+	// destination and after them for the rest)
+	var profiles []string
+	profileRules := map[string][]string{}
+	for _, name := range c.profileNames() {
+		p := c.Profiles[name]
+		if !p.hasFirewall() {
+			continue
+		}
+
+		dst, anyDst, err := allowRules(p.Network.Firewall.Allow)
+		if err != nil {
+			return "", fmt.Errorf("profile %v: %w", name, err)
+		}
+		if p.Network.Firewall.Default != "" {
+			anyDst = append(anyDst, p.Network.Firewall.Default)
+		}
+
+		chain := profileChain(name)
+		profiles = append(profiles, name)
+		profileRules[chain] = dst
+		profileRules[chain+"_any"] = anyDst
+	}
+	profileJumps := func(suffix string) []string {
+		var jumps []string
+		for _, name := range profiles {
+			for _, f := range []string{"ip", "ip6"} {
+				jumps = append(jumps, fmt.Sprintf("%v saddr @%v jump %v%v", f, profileSet(name, f),
+					profileChain(name), suffix))
+			}
+		}
+		return jumps
+	}
+	egress = append(profileJumps(""), egress...)
+
+	// Jails always need to be able to reach their resolvers
+	if len(resolvConf.Nameservers) != 0 {
+		for _, d := range daddrMatches(resolvConf.Nameservers) {
+			egress = append(egress, d+" meta l4proto { tcp, udp } th dport 53 accept")
+		}
+	}
+
+	var blocked []string
+	for _, b := range fw.Block {
+		_, n, err := net.ParseCIDR(b)
+		if err != nil {
+			return "", fmt.Errorf("invalid blocked range %v: %w", b, err)
+		}
+		blocked = append(blocked, n.String())
+	}
+	for _, d := range daddrMatches(blocked) {
+		egress = append(egress, d+" drop")
+	}
+	egress = append(egress, profileJumps("_any")...)
+	egress = append(egress, egressAny...)
+	egress = append(egress, fw.Default)
+
+	var b bytes.Buffer
+	table := "inet " + fw.Table
+	// Declaring the table before deleting it makes the delete succeed even if it doesn't exist yet, so the whole
+	// table is atomically replaced
+	fmt.Fprintf(&b, "table %v\ndelete table %v\n", table, table)
+	fmt.Fprintf(&b, "table %v {\n", table)
+
+	for _, name := range profiles {
+		for _, f := range []string{"ip", "ip6"} {
+			var elements []string
+			for a := range firewallMembers.addrs[name] {
+				if addrFamily(a) == f {
+					elements = append(elements, a)
+				}
+			}
+			sort.Strings(elements)
+
+			setType := "ipv4_addr"
+			if f == "ip6" {
+				setType = "ipv6_addr"
+			}
+			fmt.Fprintf(&b, "\tset %v {\n", profileSet(name, f))
+			fmt.Fprintf(&b, "\t\ttype %v\n", setType)
+			if len(elements) != 0 {
+				fmt.Fprintf(&b, "\t\telements = { %v }\n", strings.Join(elements, ", "))
+			}
+			fmt.Fprintf(&b, "\t}\n")
+		}
+	}
+
+	fmt.Fprintf(&b, "\tchain postrouting {\n")
+	fmt.Fprintf(&b, "\t\ttype nat hook postrouting priority 100; policy accept;\n")
+	for _, a := range []net.IPNet{c.Network.Address, c.Network.Address6} {
+		if a.IP == nil {
+			continue
+		}
+
+		jailNet := net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}
+		fmt.Fprintf(&b, "\t\t%v saddr %v oifname != %v masquerade\n",
+			addrFamily(jailNet.String()), jailNet.String(), hostVeth)
+	}
+	fmt.Fprintf(&b, "\t}\n")
+
+	fmt.Fprintf(&b, "\tchain input {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook input priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %v ct state established,related accept\n", hostVeth)
+	// Jails need neighbour discovery to reach their IPv6 gateway
+	fmt.Fprintf(&b, "\t\tiifname %v icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert } accept\n", hostVeth)
+	fmt.Fprintf(&b, "\t\tiifname %v drop\n", hostVeth)
+	fmt.Fprintf(&b, "\t}\n")
+
+	fmt.Fprintf(&b, "\tchain forward {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %v jump egress\n", hostVeth)
+	fmt.Fprintf(&b, "\t\toifname %v ct state established,related accept\n", hostVeth)
+	fmt.Fprintf(&b, "\t\toifname %v drop\n", hostVeth)
+	fmt.Fprintf(&b, "\t}\n")
+
+	// Chains must be defined before they are jumped to
+	for _, name := range profiles {
+		for _, chain := range []string{profileChain(name), profileChain(name) + "_any"} {
+			fmt.Fprintf(&b, "\tchain %v {\n", chain)
+			for _, r := range profileRules[chain] {
+				fmt.Fprintf(&b, "\t\t%v\n", r)
+			}
+			fmt.Fprintf(&b, "\t}\n")
+		}
+	}
+
+	fmt.Fprintf(&b, "\tchain egress {\n")
+	fmt.Fprintf(&b, "\t\tct state established,related accept\n")
+	for _, r := range egress {
+		fmt.Fprintf(&b, "\t\t%v\n", r)
+	}
+	fmt.Fprintf(&b, "\t}\n")
+
+	fmt.Fprintf(&b, "}\n")
+	return b.String(), nil
+}
+
+func runNft(ruleset string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply ruleset: %w (output: %s)", err, out)
+	}
+
+	return nil
+}
+
+// updateFirewallMembers adds (or removes) a jail's addresses to the sets for its profile
+func updateFirewallMembers(c *JailConfig, profile string, add bool, ips ...net.IP) error {
+	if p, ok := c.Profiles[profile]; !ok || !p.hasFirewall() {
+		return nil
+	}
+
+	firewallMembers.Lock()
+	defer firewallMembers.Unlock()
+
+	members, ok := firewallMembers.addrs[profile]
+	if !ok {
+		members = make(map[string]struct{})
+		firewallMembers.addrs[profile] = members
+	}
+
+	op := "add"
+	if !add {
+		op = "delete"
+	}
+
+	var b bytes.Buffer
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+
+		a := ip.String()
+		if _, ok := members[a]; ok == add {
+			continue
+		}
+		if add {
+			members[a] = struct{}{}
+		} else {
+			delete(members, a)
+		}
+		fmt.Fprintf(&b, "%v element inet %v %v { %v }\n", op, c.Network.Firewall.Table,
+			profileSet(profile, addrFamily(a)), a)
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	return runNft(b.String())
+}
+
+// ReconcileFirewall (re-)creates shhd's nftables table for the jail network
+func ReconcileFirewall(c *JailConfig) error {
+	firewallMembers.Lock()
+	defer firewallMembers.Unlock()
+
+	ruleset, err := firewallRuleset(c)
+	if err != nil {
+		return fmt.Errorf("failed to generate ruleset: %w", err)
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0o644); err != nil {
+		return fmt.Errorf("failed to enable IPv4 forwarding: %w", err)
+	}
+	if c.Network.Address6.IP != nil {
+		if err := os.WriteFile("/proc/sys/net/ipv6/conf/all/forwarding", []byte("1"), 0o644); err != nil {
+			return fmt.Errorf("failed to enable IPv6 forwarding: %w", err)
+		}
+	}
+
+	return runNft(ruleset)
+}
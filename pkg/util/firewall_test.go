@@ -0,0 +1,222 @@
+package util
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// firewallChain returns the rules in a chain of a rendered ruleset
+func firewallChain(t *testing.T, ruleset, chain string) []string {
+	t.Helper()
+
+	start := strings.Index(ruleset, "\tchain "+chain+" {\n")
+	if start == -1 {
+		t.Fatalf("chain %v missing from ruleset:\n%v", chain, ruleset)
+	}
+	body := ruleset[start+len("\tchain "+chain+" {\n"):]
+	body = body[:strings.Index(body, "\t}\n")]
+
+	var rules []string
+	for _, l := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if l != "" {
+			rules = append(rules, strings.TrimPrefix(l, "\t\t"))
+		}
+	}
+	return rules
+}
+
+func testFirewallConfig() *JailConfig {
+	c := &JailConfig{}
+	c.Network.Interface = "nsjail"
+	c.Network.Address = net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(16, 32)}
+	c.Network.Firewall.Table = "shh"
+	c.Network.Firewall.Default = "drop"
+
+	return c
+}
+
+func TestFirewallRuleset(t *testing.T) {
+	prevResolvConf := resolvConf
+	defer func() { resolvConf = prevResolvConf }()
+
+	tests := []struct {
+		name        string
+		config      func(c *JailConfig)
+		nameservers []string
+		members     map[string][]string
+		chains      map[string][]string
+	}{
+		{
+			name: "default only",
+			chains: map[string][]string{
+				"egress": {"ct state established,related accept", "drop"},
+			},
+		},
+		{
+			name: "allow and block",
+			config: func(c *JailConfig) {
+				c.Network.Firewall.Allow = []FirewallRule{
+					{Protocol: "udp", Ports: []uint16{53}},
+					{Destination: "10.0.0.10", Protocol: "tcp", Ports: []uint16{443}},
+					{Protocol: "tcp"},
+					{Destination: "fd00::/8"},
+				}
+				c.Network.Firewall.Block = []string{"10.0.0.0/8", "fc00::/7", "172.16.1.1/12"}
+				c.Network.Firewall.Default = "accept"
+			},
+			chains: map[string][]string{
+				"egress": {
+					"ct state established,related accept",
+					"ip daddr { 10.0.0.10 } tcp dport { 443 } accept",
+					"ip6 daddr { fd00::/8 } accept",
+					"ip daddr { 10.0.0.0/8, 172.16.0.0/12 } drop",
+					"ip6 daddr { fc00::/7 } drop",
+					"udp dport { 53 } accept",
+					"meta l4proto tcp accept",
+					"accept",
+				},
+			},
+		},
+		{
+			name:        "resolvers are reachable before blocked ranges",
+			config:      func(c *JailConfig) { c.Network.Firewall.Block = []string{"10.0.0.0/8"} },
+			nameservers: []string{"10.0.0.53", "fd00::53", "10.0.1.53"},
+			chains: map[string][]string{
+				"egress": {
+					"ct state established,related accept",
+					"ip daddr { 10.0.0.53, 10.0.1.53 } meta l4proto { tcp, udp } th dport 53 accept",
+					"ip6 daddr { fd00::53 } meta l4proto { tcp, udp } th dport 53 accept",
+					"ip daddr { 10.0.0.0/8 } drop",
+					"drop",
+				},
+			},
+		},
+		{
+			name: "dual-stack masquerading",
+			config: func(c *JailConfig) {
+				c.Network.Address6 = net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}
+			},
+			chains: map[string][]string{
+				"postrouting": {
+					"type nat hook postrouting priority 100; policy accept;",
+					`ip saddr 192.168.0.0/16 oifname != "nsjail-host" masquerade`,
+					`ip6 saddr fd00::/64 oifname != "nsjail-host" masquerade`,
+				},
+			},
+		},
+		{
+			name: "profiles",
+			config: func(c *JailConfig) {
+				c.Network.Firewall.Block = []string{"10.0.0.0/8"}
+
+				staff := Profile{}
+				staff.Network.Firewall.Default = "accept"
+				tutorial := Profile{}
+				tutorial.Network.Firewall.Allow = []FirewallRule{
+					{Destination: "10.0.0.22", Protocol: "tcp", Ports: []uint16{22, 80}},
+					{Protocol: "udp", Ports: []uint16{123}},
+				}
+				c.Profiles = map[string]Profile{"tutorial": tutorial, "staff": staff, "plain": {HomeSize: 1}}
+			},
+			members: map[string][]string{"staff": {"192.168.0.3", "fd00::3", "192.168.0.2"}},
+			chains: map[string][]string{
+				"egress": {
+					"ct state established,related accept",
+					"ip saddr @profile_staff_v4 jump profile_staff",
+					"ip6 saddr @profile_staff_v6 jump profile_staff",
+					"ip saddr @profile_tutorial_v4 jump profile_tutorial",
+					"ip6 saddr @profile_tutorial_v6 jump profile_tutorial",
+					"ip daddr { 10.0.0.0/8 } drop",
+					"ip saddr @profile_staff_v4 jump profile_staff_any",
+					"ip6 saddr @profile_staff_v6 jump profile_staff_any",
+					"ip saddr @profile_tutorial_v4 jump profile_tutorial_any",
+					"ip6 saddr @profile_tutorial_v6 jump profile_tutorial_any",
+					"drop",
+				},
+				"profile_staff":        nil,
+				"profile_staff_any":    {"accept"},
+				"profile_tutorial":     {"ip daddr { 10.0.0.22 } tcp dport { 22, 80 } accept"},
+				"profile_tutorial_any": {"udp dport { 123 } accept"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testFirewallConfig()
+			if tt.config != nil {
+				tt.config(c)
+			}
+			resolvConf = DNSConfig{Nameservers: tt.nameservers}
+
+			firewallMembers.Lock()
+			defer firewallMembers.Unlock()
+			prevMembers := firewallMembers.addrs
+			defer func() { firewallMembers.addrs = prevMembers }()
+			firewallMembers.addrs = make(map[string]map[string]struct{})
+			for profile, addrs := range tt.members {
+				firewallMembers.addrs[profile] = make(map[string]struct{})
+				for _, a := range addrs {
+					firewallMembers.addrs[profile][a] = struct{}{}
+				}
+			}
+
+			ruleset, err := firewallRuleset(c)
+			if err != nil {
+				t.Fatalf("firewallRuleset() failed: %v", err)
+			}
+			if !strings.HasPrefix(ruleset, "table inet shh\ndelete table inet shh\ntable inet shh {\n") {
+				t.Errorf("ruleset doesn't replace the table:\n%v", ruleset)
+			}
+
+			for chain, want := range tt.chains {
+				if got := firewallChain(t, ruleset, chain); strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("chain %v = %q, want %q", chain, got, want)
+				}
+			}
+			if strings.Contains(ruleset, "profile_plain") {
+				t.Errorf("ruleset contains chains for a profile without a firewall policy:\n%v", ruleset)
+			}
+			if len(tt.members) != 0 && !strings.Contains(ruleset,
+				"\tset profile_staff_v4 {\n\t\ttype ipv4_addr\n\t\telements = { 192.168.0.2, 192.168.0.3 }\n\t}\n"+
+					"\tset profile_staff_v6 {\n\t\ttype ipv6_addr\n\t\telements = { fd00::3 }\n\t}\n") {
+				t.Errorf("ruleset doesn't contain the profile's members:\n%v", ruleset)
+			}
+		})
+	}
+}
+
+func TestFirewallRulesetErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(c *JailConfig)
+	}{
+		{"unknown default", func(c *JailConfig) { c.Network.Firewall.Default = "reject" }},
+		{"ports without protocol", func(c *JailConfig) {
+			c.Network.Firewall.Allow = []FirewallRule{{Ports: []uint16{22}}}
+		}},
+		{"unknown protocol", func(c *JailConfig) {
+			c.Network.Firewall.Allow = []FirewallRule{{Protocol: "sctp"}}
+		}},
+		{"invalid blocked range", func(c *JailConfig) { c.Network.Firewall.Block = []string{"10.0.0.0"} }},
+		{"invalid profile rule", func(c *JailConfig) {
+			p := Profile{}
+			p.Network.Firewall.Allow = []FirewallRule{{Protocol: "icmp"}}
+			c.Profiles = map[string]Profile{"broken": p}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testFirewallConfig()
+			tt.config(c)
+
+			firewallMembers.Lock()
+			defer firewallMembers.Unlock()
+			if ruleset, err := firewallRuleset(c); err == nil {
+				t.Errorf("firewallRuleset() succeeded, want error:\n%v", ruleset)
+			}
+		})
+	}
+}
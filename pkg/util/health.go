@@ -0,0 +1,51 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/vishvananda/netlink"
+)
+
+// CheckJailHost checks that the host is still able to run jails (i.e. what InitJail() set up is in place), returning
+// the result of each check by name (nil if the check passed)
+func CheckJailHost(c *JailConfig) map[string]error {
+	checks := make(map[string]error)
+
+	if _, err := exec.LookPath("nsjail"); err != nil {
+		checks["nsjail"] = fmt.Errorf("nsjail binary not found: %w", err)
+	} else {
+		checks["nsjail"] = nil
+	}
+
+	for _, cg := range []string{"memory", "pids", "cpu"} {
+		name := "cgroup_" + cg
+		if _, err := os.Stat(path.Join("/sys/fs/cgroup", cg, c.Cgroups.Name)); err != nil {
+			checks[name] = fmt.Errorf("cgroup %v parent %v missing: %w", cg, c.Cgroups.Name, err)
+		} else {
+			checks[name] = nil
+		}
+	}
+
+	if c.Network.Interface != "" {
+		checks["veth"] = checkVeth(c.Network.Interface + "-host")
+	}
+
+	return checks
+}
+
+func checkVeth(name string) error {
+	veth, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to get host veth: %w", err)
+	}
+	if veth.Attrs().Flags&net.FlagUp == 0 {
+		return errors.New("host veth is down")
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+
+	iam "github.com/netsoc/iam/client"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// HomeBackendTmpfs gives each jail a fresh tmpfs home directory
+	HomeBackendTmpfs = "tmpfs"
+	// HomeBackendImage gives each user a persistent loop-mounted ext4 image as their home directory
+	HomeBackendImage = "image"
+)
+
+var homeMounts = struct {
+	sync.Mutex
+	refs map[string]int
+}{refs: make(map[string]int)}
+
+func checkHomeConfig(c *JailConfig) error {
+	switch c.Home.Backend {
+	case HomeBackendTmpfs:
+		return nil
+	case HomeBackendImage:
+		if c.Home.Root == "" {
+			return errors.New("home root must be set for image backend")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown home backend %v", c.Home.Backend)
+	}
+}
+
+// initHome prepares the host for the configured home backend
+func initHome(c *JailConfig) error {
+	if c.Home.Backend != HomeBackendImage {
+		return nil
+	}
+
+	if err := os.MkdirAll(c.Home.Root, 0o700); err != nil {
+		return fmt.Errorf("failed to create home root: %w", err)
+	}
+	return nil
+}
+
+// homeDir is the host path a user's home directory image is mounted at
+func homeDir(c *JailConfig, u *iam.User) string {
+	return path.Join(c.Home.Root, u.Username)
+}
+
+func runTool(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v failed: %w (output: %s)", name, err, out)
+	}
+
+	return nil
+}
+
+func prepareHomeImage(c *JailConfig, img string) error {
+	info, err := os.Stat(img)
+	if os.IsNotExist(err) {
+		f, err := os.OpenFile(img, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to create image: %w", err)
+		}
+		if err := f.Truncate(int64(c.HomeSize)); err != nil {
+			f.Close()
+			os.Remove(img)
+			return fmt.Errorf("failed to allocate image: %w", err)
+		}
+		f.Close()
+
+		// Root of the filesystem is owned by the mapped root user so the jail can write to it
+		if err := runTool("mkfs.ext4", "-q", "-F", "-m", "0",
+			"-E", fmt.Sprintf("root_owner=%v:%v", c.UIDStart, c.GIDStart), img); err != nil {
+			os.Remove(img)
+			return err
+		}
+
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error stat'ing image: %w", err)
+	}
+
+	if uint64(info.Size()) < c.HomeSize {
+		log.WithFields(log.Fields{
+			"image":   img,
+			"oldSize": info.Size(),
+			"newSize": c.HomeSize,
+		}).Info("Growing home image")
+
+		if err := os.Truncate(img, int64(c.HomeSize)); err != nil {
+			return fmt.Errorf("failed to grow image: %w", err)
+		}
+		if err := runTool("e2fsck", "-f", "-p", img); err != nil {
+			return err
+		}
+		if err := runTool("resize2fs", img); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AcquireHome prepares a user's home directory, returning the host path to bind mount into the jail (or an empty
+// string if the jail should use a tmpfs)
+func AcquireHome(c *JailConfig, u *iam.User) (string, error) {
+	if c.Home.Backend != HomeBackendImage {
+		return "", nil
+	}
+
+	homeMounts.Lock()
+	defer homeMounts.Unlock()
+
+	dir := homeDir(c, u)
+	if homeMounts.refs[u.Username] > 0 {
+		homeMounts.refs[u.Username]++
+		return dir, nil
+	}
+
+	img := dir + ".img"
+	if err := prepareHomeImage(c, img); err != nil {
+		return "", fmt.Errorf("failed to prepare home image: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create home mountpoint: %w", err)
+	}
+
+	// Clean up any mount left behind by a previous instance
+	if err := unix.Unmount(dir, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+		return "", fmt.Errorf("failed to unmount stale home: %w", err)
+	}
+	if err := runTool("mount", "-o", "loop,nosuid,nodev", img, dir); err != nil {
+		return "", fmt.Errorf("failed to mount home image: %w", err)
+	}
+
+	homeMounts.refs[u.Username] = 1
+	return dir, nil
+}
+
+// ReleaseHome releases a reference to a user's home directory, unmounting it if it is no longer in use
+func ReleaseHome(c *JailConfig, u *iam.User) error {
+	if c.Home.Backend != HomeBackendImage {
+		return nil
+	}
+
+	homeMounts.Lock()
+	defer homeMounts.Unlock()
+
+	homeMounts.refs[u.Username]--
+	if homeMounts.refs[u.Username] > 0 {
+		return nil
+	}
+	delete(homeMounts.refs, u.Username)
+
+	if err := unix.Unmount(path.Join(c.Home.Root, u.Username), 0); err != nil {
+		return fmt.Errorf("failed to unmount home image: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// ErrPoolExhausted indicates that there are no free addresses left to lease
+var ErrPoolExhausted = errors.New("address pool exhausted")
+
+// IPAM leases unique addresses from a network
+type IPAM struct {
+	lock sync.Mutex
+
+	base   *big.Int
+	size   *big.Int
+	bits   int
+	first  *big.Int
+	last   *big.Int
+	next   *big.Int
+	leases map[string]struct{}
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(i *big.Int, bits int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, bits/8)
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+// NewIPAM creates a new IPAM leasing addresses from n (excluding the network and broadcast addresses and any
+// reserved addresses)
+func NewIPAM(n net.IPNet, reserved ...net.IP) *IPAM {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		n.IP = n.IP.To4()
+	}
+
+	p := &IPAM{
+		base:   ipToInt(n.IP.Mask(n.Mask)),
+		size:   new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)),
+		bits:   bits,
+		leases: make(map[string]struct{}),
+	}
+
+	// Skip the network address (and broadcast address for IPv4)
+	p.first = new(big.Int).Add(p.base, big.NewInt(1))
+	p.last = new(big.Int).Add(p.base, p.size)
+	p.last.Sub(p.last, big.NewInt(1))
+	if bits == 32 {
+		p.last.Sub(p.last, big.NewInt(1))
+	}
+	p.next = new(big.Int).Set(p.first)
+
+	// Only addresses that could be leased count towards the pool being exhausted
+	for _, ip := range reserved {
+		if ip == nil || !n.Contains(ip) {
+			continue
+		}
+		if i := ipToInt(ip); i.Cmp(p.first) >= 0 && i.Cmp(p.last) <= 0 {
+			p.leases[i.String()] = struct{}{}
+		}
+	}
+
+	return p
+}
+
+// Lease allocates a free address from the pool
+func (p *IPAM) Lease() (net.IP, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.last.Cmp(p.first) < 0 {
+		return nil, ErrPoolExhausted
+	}
+	usable := new(big.Int).Sub(p.last, p.first)
+	usable.Add(usable, big.NewInt(1))
+	if big.NewInt(int64(len(p.leases))).Cmp(usable) >= 0 {
+		return nil, ErrPoolExhausted
+	}
+
+	// Search from where the last lease left off, so recently released addresses aren't immediately reused
+	i := new(big.Int).Set(p.next)
+	for {
+		if i.Cmp(p.last) > 0 {
+			i.Set(p.first)
+		}
+
+		if _, ok := p.leases[i.String()]; !ok {
+			p.leases[i.String()] = struct{}{}
+			p.next.Add(i, big.NewInt(1))
+			return intToIP(i, p.bits), nil
+		}
+
+		i.Add(i, big.NewInt(1))
+		if i.Cmp(p.next) == 0 {
+			return nil, ErrPoolExhausted
+		}
+	}
+}
+
+// Release returns an address to the pool
+func (p *IPAM) Release(ip net.IP) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.leases, ipToInt(ip).String())
+}
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("failed to parse %v: %v", s, err)
+	}
+
+	n.IP = ip
+	return *n
+}
+
+func TestIPAMLease(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		reserved []string
+		want     []string
+	}{
+		{
+			name:    "ipv4 skips network and broadcast",
+			network: "10.0.0.0/29",
+			want:    []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"},
+		},
+		{
+			name:     "ipv4 skips gateway",
+			network:  "192.168.0.1/29",
+			reserved: []string{"192.168.0.1"},
+			want:     []string{"192.168.0.2", "192.168.0.3", "192.168.0.4", "192.168.0.5", "192.168.0.6"},
+		},
+		{
+			name:     "ipv4 reserved outside the network",
+			network:  "192.168.0.1/30",
+			reserved: []string{"192.168.0.1", "10.0.0.1"},
+			want:     []string{"192.168.0.2"},
+		},
+		{
+			name:     "ipv4 reserved network and broadcast",
+			network:  "10.0.0.0/30",
+			reserved: []string{"10.0.0.0", "10.0.0.3"},
+			want:     []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:    "ipv4 /31 has no usable addresses",
+			network: "10.0.0.0/31",
+		},
+		{
+			name:     "ipv6 keeps the last address",
+			network:  "fd00::1/126",
+			reserved: []string{"fd00::1"},
+			want:     []string{"fd00::2", "fd00::3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reserved []net.IP
+			for _, r := range tt.reserved {
+				reserved = append(reserved, net.ParseIP(r))
+			}
+			p := NewIPAM(mustParseCIDR(t, tt.network), reserved...)
+
+			for _, want := range tt.want {
+				ip, err := p.Lease()
+				if err != nil {
+					t.Fatalf("Lease() failed: %v, want %v", err, want)
+				}
+				if !ip.Equal(net.ParseIP(want)) {
+					t.Errorf("Lease() = %v, want %v", ip, want)
+				}
+			}
+
+			if ip, err := p.Lease(); !errors.Is(err, ErrPoolExhausted) {
+				t.Errorf("Lease() = %v, %v once all addresses are leased, want %v", ip, err, ErrPoolExhausted)
+			}
+		})
+	}
+}
+
+func TestIPAMRelease(t *testing.T) {
+	p := NewIPAM(mustParseCIDR(t, "10.0.0.1/29"), net.ParseIP("10.0.0.1"))
+
+	var leased []net.IP
+	for i := 0; i < 5; i++ {
+		ip, err := p.Lease()
+		if err != nil {
+			t.Fatalf("Lease() failed: %v", err)
+		}
+		leased = append(leased, ip)
+	}
+	if _, err := p.Lease(); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Lease() = %v, want %v", err, ErrPoolExhausted)
+	}
+
+	// Released addresses can be leased again (16-byte IPs are the same as 4-byte ones)
+	p.Release(net.ParseIP("10.0.0.4"))
+	ip, err := p.Lease()
+	if err != nil {
+		t.Fatalf("Lease() after Release() failed: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.0.0.4")) {
+		t.Errorf("Lease() after Release() = %v, want 10.0.0.4", ip)
+	}
+
+	// The search continues from the last lease rather than reusing the lowest free address
+	p.Release(leased[0])
+	p.Release(leased[4])
+	ip, err = p.Lease()
+	if err != nil {
+		t.Fatalf("Lease() after Release() failed: %v", err)
+	}
+	if !ip.Equal(leased[4]) {
+		t.Errorf("Lease() after releasing %v and %v = %v, want %v", leased[0], leased[4], ip, leased[4])
+	}
+	ip, err = p.Lease()
+	if err != nil {
+		t.Fatalf("Lease() after Release() failed: %v", err)
+	}
+	if !ip.Equal(leased[0]) {
+		t.Errorf("second Lease() = %v, want %v", ip, leased[0])
+	}
+
+	// Releasing an address that isn't leased (or the gateway) doesn't free up anything else
+	p.Release(net.ParseIP("10.1.0.1"))
+	if ip, err := p.Lease(); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Lease() = %v, %v, want %v", ip, err, ErrPoolExhausted)
+	}
+}
@@ -1,8 +1,6 @@
 package util
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,16 +8,33 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"syscall"
-	"text/template"
+	"time"
 
-	"github.com/MakeNowJust/heredoc"
-	"github.com/Masterminds/sprig/v3"
 	iam "github.com/netsoc/iam/client"
+	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"golang.org/x/sys/unix"
 )
 
+const (
+	agentDir          = "/run/shh"
+	agentBin          = "/.shhd"
+	agentSocket       = "agent.sock"
+	agentStartTimeout = 10 * time.Second
+
+	// jailAgentDir is the only part of a jail's (root-owned) host directory that the jail's user can write to
+	jailAgentDir = "agent"
+	// cliConfigFile is where pooled jails have the CLI config mounted (linked into the home directory when claimed)
+	cliConfigFile = "/run/netsoc.yaml"
+
+	// jailIface is the name nsjail gives the macvlan interface inside the jail
+	jailIface = "vs"
+)
+
 var allAddr = net.IPv4(0xff, 0xff, 0xff, 0xff)
 
 var cliConfig map[string]interface{}
@@ -41,13 +56,38 @@ type JailConfig struct {
 	} `mapstructure:"cgroups"`
 
 	HomeSize uint64 `mapstructure:"home_size"`
+	Home     struct {
+		Backend string
+		Root    string
+	}
 	Greeting string
 
 	CLIExtra map[string]interface{} `mapstructure:"cli_extra"`
 
+	DNS     DNSConfig
+	Hosts   []HostsEntry
+	Mounts  []Mount
+	Seccomp SeccompConfig
+
+	// Shells maps shell names to their paths
+	Shells map[string]string
+	// Shell is the name of the default login shell
+	Shell string
+	// LimitHelp is shown to users when their jail hits a resource limit
+	LimitHelp string `mapstructure:"limit_help"`
+	// SessionDuration is the maximum length of a session (0 for unlimited)
+	SessionDuration time.Duration `mapstructure:"session_duration"`
+
+	Profiles     map[string]Profile
+	ProfileRules []ProfileRule `mapstructure:"profile_rules"`
+
 	Network struct {
 		Interface string
 		Address   net.IPNet
+		// Address6 is the (optional) IPv6 gateway address and prefix for jails
+		Address6  net.IPNet `mapstructure:"address6"`
+		Firewall  FirewallConfig
+		Bandwidth BandwidthConfig
 	}
 }
 
@@ -56,211 +96,173 @@ type jailNetInfo struct {
 	Mask string
 }
 type jailInfo struct {
-	Config    *JailConfig
-	User      *iam.User
-	CLIConfig map[string]interface{}
-	Path      string
-	Command   string
+	Config   *JailConfig
+	User     *iam.User
+	Path     string
+	Home     string
+	Dir      string
+	Agent    string
+	Hostname string
+	Profile  string
+	Shell    string
+	// Pooled jails are generic until they are claimed (see StartPooledJail())
+	Pooled bool
 
 	Net jailNetInfo
 }
 
-var configTemplate = template.Must(template.New("nsjail.cfg").Funcs(sprig.GenericFuncMap()).Funcs(TemplateFuncs).Parse(heredoc.Doc(`
-	name: "shhd-fish"
-	description: "nsjail config to run restricted fish"
-
-	mode: ONCE
-	hostname: "{{ .User.Username }}-netsoc"
-	cwd: "/home/{{ .User.Username }}"
-
-	time_limit: 0
-	daemon: false
-	max_cpus: 1
-
-	log_fd: 3
-	log_level: {{ .Config.LogLevel }}
-
-	keep_env: true
-
-	cap: "CAP_SETUID"
-	cap: "CAP_SETGID"
-	cap: "CAP_NET_RAW"
-	skip_setsid: true
-
-	cgroup_mem_parent: "{{ .Config.Cgroups.Name }}"
-	cgroup_pids_parent: "{{ .Config.Cgroups.Name }}"
-	cgroup_cpu_parent: "{{ .Config.Cgroups.Name }}"
-	cgroup_mem_max: {{ .Config.Cgroups.Memory }}
-	cgroup_pids_max: {{ .Config.Cgroups.PIDs }}
-	cgroup_cpu_ms_per_sec: {{ .Config.Cgroups.CPUTime }}
-
-	uidmap {
-		inside_id: "0"
-		outside_id: "{{ .Config.UIDStart }}"
-	}
-	gidmap {
-		inside_id: "0"
-		outside_id: "{{ .Config.GIDStart }}"
-	}
-
-	mount {
-		dst: "/dev"
-		fstype: "tmpfs"
-		options: "size=8388608"
-		rw: true
-		is_bind: false
-	}
-	mount {
-		src: "{{ .Config.TmpDir }}/null"
-		dst: "/dev/null"
-		rw: true
-		is_bind: true
-	}
-	mount {
-		src: "{{ .Config.TmpDir }}/zero"
-		dst: "/dev/zero"
-		rw: true
-		is_bind: true
-	}
-	mount {
-		src: "{{ .Config.TmpDir }}/random"
-		dst: "/dev/random"
-		is_bind: true
-	}
-	mount {
-		src: "{{ .Config.TmpDir }}/urandom"
-		dst: "/dev/urandom"
-		is_bind: true
-	}
-
-	mount {
-		dst: "/proc"
-		fstype: "proc"
-		rw: false
-	}
-	mount {
-		src: "/proc/self/fd"
-		dst: "/dev/fd"
-		is_symlink: true
-	}
-
-	mount {
-		src: "/lib"
-		dst: "/lib"
-		is_bind: true
-		rw: false
-	}
-	mount {
-		src: "/lib64"
-		dst: "/lib64"
-		is_bind: true
-		rw: false
-	}
-	mount {
-		src: "/bin"
-		dst: "/bin"
-		is_bind: true
-		rw: false
-	}
-	mount {
-		src: "/sbin"
-		dst: "/sbin"
-		is_bind: true
-	}
-	mount {
-		src: "/usr"
-		dst: "/usr"
-		is_bind: true
-	}
-
-	mount {
-		src: "/etc/shells"
-		dst: "/etc/shells"
-		is_bind: true
-	}
-	mount {
-		src: "/etc/terminfo"
-		dst: "/etc/terminfo"
-		is_bind: true
-	}
-	mount {
-		src: "/etc/fish"
-		dst: "/etc/fish"
-		is_bind: true
-	}
-	mount {
-		src: "/etc/ssl"
-		dst: "/etc/ssl"
-		is_bind: true
-	}
-	mount {
-		src: "/etc/man_db.conf"
-		dst: "/etc/man_db.conf"
-		is_bind: true
-	}
-	mount {
-		src: "/var/cache/man"
-		dst: "/var/cache/man"
-		is_bind: true
-	}
-
-	mount {
-		dst: "/tmp"
-		fstype: "tmpfs"
-		options: "size=8388608"
-		rw: true
-		is_bind: false
-	}
-
-	mount {
-		dst: "/etc/passwd"
-		src_content: "{{ .User.Username }}:x:0:0::/home/{{ .User.Username }}:/usr/bin/fish\n"
-	}
-	mount {
-		dst: "/etc/group"
-		src_content: "{{ .User.Username }}:x:0:\n"
-	}
-	mount {
-		dst: "/etc/resolv.conf"
-		src_content: "nameserver 1.1.1.1\nnameserver 1.0.0.1\n"
-	}
-	mount {
-		dst: "/etc/fish/config.fish"
-		src_content: "set -gx PATH {{ .Path }}\nfunction fish_greeting\n    echo \"{{ b64enc .Config.Greeting }}\" | base64 -d\nend\n"
-	}
-
-	mount {
-		dst: "/home/{{ .User.Username }}"
-		fstype: "tmpfs"
-		options: "size={{ .Config.HomeSize }}"
-		rw: true
-		is_bind: false
-	}
-	mount {
-		dst: "/home/{{ .User.Username }}/.netsoc.yaml"
-		src_content: "{{ .CLIConfig | mustToRawJson | toBytes | bytesToCString }}"
-		rw: true
-	}
-
-	seccomp_string: "KILL { syslog }"
-	seccomp_string: "DEFAULT ALLOW"
-
-	macvlan_iface: "{{ .Config.Network.Interface }}-jail"
-	macvlan_vs_ip: "{{ .Net.IP }}"
-	macvlan_vs_nm: "{{ .Net.Mask }}"
-	macvlan_vs_gw: "{{ .Config.Network.Address.IP }}"
-
-	exec_bin {
-		path: "/bin/su"
-		arg0: "su"
-		arg: "-"
-		arg: "{{ .User.Username }}"
-	{{- if .Command }}
-		arg: "-c"
-		arg: "{{ .Command }}"
-	{{- end }}
+// checkUsername makes sure a username is safe to use in paths and the jail's passwd / group files
+func checkUsername(username string) error {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, ":/\n\x00") {
+		return fmt.Errorf("invalid username %q", username)
+	}
+
+	return nil
+}
+
+// nsjailConfig builds the nsjail configuration for a jail
+func (i *jailInfo) nsjailConfig() *nsjailConfig {
+	c := i.Config
+	home := path.Join("/home", i.User.Username)
+	if i.Pooled {
+		// The user's home directory is created when the jail is claimed
+		home = "/home"
+	}
+	devices := func(names ...string) []nsjailMount {
+		var mounts []nsjailMount
+		for _, n := range names {
+			mounts = append(mounts, nsjailMount{
+				Src:    path.Join(c.TmpDir, n),
+				Dst:    path.Join("/dev", n),
+				IsBind: true,
+				RW:     n == "null" || n == "zero",
+			})
+		}
+		return mounts
+	}
+
+	cfg := &nsjailConfig{
+		Name:        "shhd-" + i.User.Username,
+		Description: "nsjail config to run the shhd agent for restricted shell sessions",
+		Hostname:    i.Hostname,
+		Cwd:         home,
+
+		MaxCPUs:  1,
+		LogFD:    3,
+		LogLevel: c.LogLevel,
+
+		KeepEnv:    true,
+		Caps:       []string{"CAP_SETUID", "CAP_SETGID", "CAP_NET_RAW"},
+		SkipSetsid: true,
+
+		CgroupParent:      c.Cgroups.Name,
+		CgroupMemMax:      c.Cgroups.Memory,
+		CgroupPidsMax:     c.Cgroups.PIDs,
+		CgroupCPUMsPerSec: c.Cgroups.CPUTime,
+
+		UIDMap: []nsjailIDMap{{InsideID: "0", OutsideID: strconv.FormatUint(uint64(c.UIDStart), 10)}},
+		GIDMap: []nsjailIDMap{{InsideID: "0", OutsideID: strconv.FormatUint(uint64(c.GIDStart), 10)}},
+
+		SeccompString: []string{seccompPolicy},
+		SeccompLog:    c.Seccomp.Log,
+
+		ExecBin: nsjailExe{
+			Path: agentBin,
+			Arg0: "shhd",
+			Args: []string{AgentCommand, path.Join(agentDir, agentSocket)},
+		},
+	}
+
+	cfg.Mounts = append(cfg.Mounts, nsjailMount{Dst: "/dev", Fstype: "tmpfs", Options: "size=8388608", RW: true})
+	cfg.Mounts = append(cfg.Mounts, devices("null", "zero", "random", "urandom")...)
+	cfg.Mounts = append(cfg.Mounts,
+		nsjailMount{Dst: "/proc", Fstype: "proc"},
+		nsjailMount{Src: "/proc/self/fd", Dst: "/dev/fd", IsSymlink: true},
+	)
+
+	for _, m := range jailMounts[i.Profile] {
+		cfg.Mounts = append(cfg.Mounts, nsjailMount{
+			Src:     m.Src,
+			Dst:     m.Dst,
+			Fstype:  m.Type,
+			Options: m.Options,
+			IsBind:  m.Type == "",
+			RW:      m.RW,
+		})
+	}
+
+	if i.Pooled {
+		// Written by the host when the jail is claimed
+		cfg.Mounts = append(cfg.Mounts,
+			nsjailMount{Src: path.Join(i.Dir, "passwd"), Dst: "/etc/passwd", IsBind: true},
+			nsjailMount{Src: path.Join(i.Dir, "group"), Dst: "/etc/group", IsBind: true},
+		)
+	} else {
+		cfg.Mounts = append(cfg.Mounts,
+			nsjailMount{
+				Dst:        "/etc/passwd",
+				SrcContent: []byte(fmt.Sprintf("%v:x:0:0::%v:%v\n", i.User.Username, home, i.Shell)),
+			},
+			nsjailMount{
+				Dst:        "/etc/group",
+				SrcContent: []byte(fmt.Sprintf("%v:x:0:\n", i.User.Username)),
+			},
+		)
+	}
+	cfg.Mounts = append(cfg.Mounts,
+		nsjailMount{Src: path.Join(i.Dir, "resolv.conf"), Dst: "/etc/resolv.conf", IsBind: true},
+		nsjailMount{Src: path.Join(i.Dir, "hosts"), Dst: "/etc/hosts", IsBind: true},
+	)
+
+	shells := []string{i.Shell}
+	if i.Pooled {
+		// Any shell might be chosen when the jail is claimed
+		shells = nil
+		for _, name := range c.ShellNames() {
+			shells = append(shells, c.Shells[name])
+		}
+	}
+	rcFiles := map[string]struct{}{}
+	for _, shell := range shells {
+		for _, rc := range shellRCFiles(shell, i.Path, c.Greeting) {
+			if _, ok := rcFiles[rc.Path]; ok {
+				continue
+			}
+			rcFiles[rc.Path] = struct{}{}
+
+			cfg.Mounts = append(cfg.Mounts, nsjailMount{Dst: rc.Path, SrcContent: rc.Content})
+		}
+	}
+
+	if i.Home != "" {
+		cfg.Mounts = append(cfg.Mounts, nsjailMount{Src: i.Home, Dst: home, IsBind: true, RW: true})
+	} else {
+		cfg.Mounts = append(cfg.Mounts, nsjailMount{
+			Dst:     home,
+			Fstype:  "tmpfs",
+			Options: fmt.Sprintf("size=%v", c.HomeSize),
+			RW:      true,
+		})
+	}
+	cliConfigDst := path.Join(home, ".netsoc.yaml")
+	if i.Pooled {
+		cliConfigDst = cliConfigFile
+	}
+	cfg.Mounts = append(cfg.Mounts,
+		nsjailMount{Src: path.Join(i.Dir, "netsoc.yaml"), Dst: cliConfigDst, IsBind: true, RW: true},
+		nsjailMount{Src: path.Join(i.Dir, jailAgentDir), Dst: agentDir, IsBind: true, RW: true},
+		nsjailMount{Src: i.Agent, Dst: agentBin, IsBind: true},
+	)
+
+	if c.Network.Interface != "" {
+		cfg.MacvlanIface = c.Network.Interface + "-jail"
+		cfg.MacvlanVsIP = i.Net.IP.String()
+		cfg.MacvlanVsNm = i.Net.Mask
+		cfg.MacvlanVsGw = c.Network.Address.IP.String()
 	}
-`)))
+
+	return cfg
+}
 
 // InitJail initializes the jail environment
 func InitJail(c *JailConfig) error {
@@ -289,6 +291,13 @@ func InitJail(c *JailConfig) error {
 		}
 	}
 
+	if err := CheckJailConfig(c, true); err != nil {
+		return err
+	}
+	if err := initHome(c); err != nil {
+		return err
+	}
+
 	for _, cg := range []string{"memory", "pids", "cpu"} {
 		if err := os.MkdirAll(path.Join("/sys/fs/cgroup", cg, c.Cgroups.Name), 775); err != nil {
 			return fmt.Errorf("failed to create cgroup %v parent %v: %w", cg, c.Cgroups.Name, err)
@@ -317,9 +326,20 @@ func InitJail(c *JailConfig) error {
 	if err := netlink.LinkSetUp(veth); err != nil {
 		return fmt.Errorf("failed to set host veth up: %w", err)
 	}
+	if err := initShaping(veth); err != nil {
+		return fmt.Errorf("failed to set up traffic shaping: %w", err)
+	}
 	if err := netlink.AddrAdd(veth, &netlink.Addr{IPNet: &c.Network.Address}); err != nil {
 		return fmt.Errorf("failed to add IP to host veth: %w", err)
 	}
+	if c.Network.Address6.IP != nil {
+		if err := netlink.AddrAdd(veth, &netlink.Addr{
+			IPNet: &c.Network.Address6,
+			Flags: unix.IFA_F_NODAD,
+		}); err != nil {
+			return fmt.Errorf("failed to add IPv6 address to host veth: %w", err)
+		}
+	}
 
 	jailVeth, err := netlink.LinkByName(jailVethName)
 	if err != nil {
@@ -329,7 +349,10 @@ func InitJail(c *JailConfig) error {
 		return fmt.Errorf("failed to set jail veth up: %w", err)
 	}
 
-	if err := exec.Command("firewall.sh", c.Network.Address.String()).Run(); err != nil {
+	if err := initDNS(c); err != nil {
+		return fmt.Errorf("failed to set up DNS: %w", err)
+	}
+	if err := ReconcileFirewall(c); err != nil {
 		return fmt.Errorf("failed to set up firewall: %w", err)
 	}
 
@@ -349,46 +372,424 @@ func InitJail(c *JailConfig) error {
 	return nil
 }
 
-// NewShellJail creates a new exec.Cmd for running fish in an nsjail
-func NewShellJail(c *JailConfig, u *iam.User, token, pathVar, command string) (*exec.Cmd, error) {
-	filename := path.Join(c.TmpDir, fmt.Sprintf("u%v.cfg", u.Id))
+// Jail represents a running nsjail, inside which processes are started by the shhd agent
+type Jail struct {
+	User    *iam.User
+	Profile string
+	IP      net.IP
+	IP6     net.IP
+
+	config *JailConfig
+	dir    string
+	cmd    *exec.Cmd
+	done   chan struct{}
+	// pid is the (host) PID of the agent
+	pid int
+
+	shapingClass uint16
+	usage        jailUsage
+	logs         jailLog
+}
+
+// JailOptions represents per-jail settings
+type JailOptions struct {
+	// Token is the IAM token for the CLI
+	Token string
+	// Path is the PATH for shells in the jail
+	Path string
+	// Home is the host path to a persistent home directory (or empty for a tmpfs)
+	Home string
+	// Profile is the name of the profile c was derived from (see JailConfig.ForUser())
+	Profile string
+	// Shell is the name of the user's login shell (the default if empty)
+	Shell string
+
+	// IP and IP6 are the jail's addresses, leased from the network's IPAMs
+	IP  net.IP
+	IP6 net.IP
+
+	Bandwidth Bandwidth
+}
+
+// StartJail starts a new nsjail for a user, running the shhd agent
+func StartJail(c *JailConfig, u *iam.User, opts JailOptions) (*Jail, error) {
+	if err := checkUsername(u.Username); err != nil {
+		return nil, err
+	}
+
+	return newJail(c, u, u.Username, opts, false)
+}
+
+func newJail(c *JailConfig, u *iam.User, dirPrefix string, opts JailOptions, pooled bool) (*Jail, error) {
+	agent, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shhd executable path: %w", err)
+	}
 
-	f, err := os.Create(filename)
+	// Jail directories are owned by root (so the files shhd writes can't be swapped out from inside the jail), but
+	// nsjail needs to be able to reach them as the jail's user
+	if err := os.MkdirAll(path.Join(c.TmpDir, "jails"), 0o711); err != nil {
+		return nil, fmt.Errorf("failed to create jails directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(path.Join(c.TmpDir, "jails"), dirPrefix+"-")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create tempfile: %w", err)
+		return nil, fmt.Errorf("failed to create jail directory: %w", err)
+	}
+	if err := os.Chmod(dir, 0o711); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to set permissions of jail directory: %w", err)
+	}
+
+	agentPath := path.Join(dir, jailAgentDir)
+	if err := os.Mkdir(agentPath, 0o700); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create agent directory: %w", err)
+	}
+	if err := os.Chown(agentPath, int(c.UIDStart), int(c.GIDStart)); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to set ownership of agent directory: %w", err)
+	}
+
+	j := &Jail{
+		User:    u,
+		Profile: opts.Profile,
+		IP:      opts.IP,
+		IP6:     opts.IP6,
+
+		config: c,
+		dir:    dir,
+		done:   make(chan struct{}),
+		usage:  jailUsage{started: time.Now()},
+	}
+	if err := j.start(agent, opts, pooled); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
 	}
 
-	cliConfig["token"] = token
-	info := jailInfo{
-		Config:    c,
-		User:      u,
-		CLIConfig: cliConfig,
-		Path:      pathVar,
-		Command:   command,
+	return j, nil
+}
+
+// newJailInfo collects the information needed to generate a jail's nsjail config
+func newJailInfo(c *JailConfig, u *iam.User, dir, agent string, opts JailOptions, pooled bool) (*jailInfo, error) {
+	info := &jailInfo{
+		Config: c,
+		User:   u,
+		Path:   opts.Path,
+		Home:   opts.Home,
+		Dir:    dir,
+		Agent:  agent,
+
+		Hostname: u.Username + "-netsoc",
+		Profile:  opts.Profile,
+		Pooled:   pooled,
+	}
+	if pooled {
+		info.Hostname = pooledHostname
+	} else {
+		shell := opts.Shell
+		if shell == "" {
+			shell = c.Shell
+		}
+
+		var err error
+		if info.Shell, err = c.ShellPath(shell); err != nil {
+			return nil, err
+		}
 	}
 
 	if c.Network.Interface != "" {
-		var ipNum uint32
-		netIPBuf := bytes.NewBuffer(c.Network.Address.IP.To4())
-		if err := binary.Read(netIPBuf, binary.BigEndian, &ipNum); err != nil {
-			return nil, fmt.Errorf("failed to convert IP address to uint32: %w", err)
+		if opts.IP == nil {
+			return nil, errors.New("no IP address provided for jail")
 		}
-		ipNum += uint32(u.Id)
 
-		var ipBuf bytes.Buffer
-		binary.Write(&ipBuf, binary.BigEndian, ipNum)
 		info.Net = jailNetInfo{
-			IP:   net.IP(ipBuf.Bytes()),
+			IP:   opts.IP,
 			Mask: allAddr.Mask(c.Network.Address.Mask).String(),
 		}
 	}
 
-	if err := configTemplate.Execute(f, info); err != nil {
-		return nil, fmt.Errorf("failed to render config template: %w", err)
+	return info, nil
+}
+
+func (j *Jail) start(agent string, opts JailOptions, pooled bool) error {
+	if err := j.SetToken(opts.Token); err != nil {
+		return err
+	}
+
+	info, err := newJailInfo(j.config, j.User, j.dir, agent, opts, pooled)
+	if err != nil {
+		return err
+	}
+	if pooled {
+		if err := j.writeIdentity(poolUser, j.config.Shells[j.config.Shell]); err != nil {
+			return err
+		}
+	}
+
+	if err := j.writeFile("resolv.conf", renderResolvConf(), 0o644, false); err != nil {
+		return fmt.Errorf("failed to write resolv.conf: %w", err)
+	}
+	if err := j.writeFile("hosts", renderHosts(j.config, info.Hostname), 0o644, false); err != nil {
+		return fmt.Errorf("failed to write hosts file: %w", err)
+	}
+
+	cfg, err := info.nsjailConfig().marshal()
+	if err != nil {
+		return fmt.Errorf("failed to generate nsjail config: %w", err)
+	}
+	cfgFile := path.Join(j.dir, "nsjail.cfg")
+	if err := j.writeFile("nsjail.cfg", cfg, 0o644, false); err != nil {
+		return fmt.Errorf("failed to write nsjail config: %w", err)
 	}
-	if err := f.Close(); err != nil {
-		return nil, fmt.Errorf("failed to close tempfile: %w", err)
+
+	logR, logW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create log pipe: %w", err)
+	}
+	defer logW.Close()
+
+	logOut := log.StandardLogger().Out
+	j.cmd = exec.Command("nsjail", "--config", cfgFile)
+	j.cmd.ExtraFiles = []*os.File{logW}
+	j.cmd.Stdout = logOut
+	j.cmd.Stderr = logOut
+	if err := j.cmd.Start(); err != nil {
+		logR.Close()
+		return fmt.Errorf("failed to start nsjail: %w", err)
+	}
+
+	go func() {
+		defer logR.Close()
+		j.copyLog(logR)
+	}()
+	go func() {
+		if err := j.cmd.Wait(); err != nil {
+			log.WithError(err).WithField("user", j.User.Username).Debug("nsjail exited")
+		}
+
+		j.usage.Lock()
+		j.usage.ended = time.Now()
+		j.usage.Unlock()
+		close(j.done)
+	}()
+
+	if err := j.waitAgent(); err != nil {
+		return err
 	}
+	go j.monitor()
 
-	return exec.Command("nsjail", "--config", f.Name()), nil
+	if j.config.Network.Interface != "" {
+		if err := j.configureNetwork(opts.Bandwidth); err != nil {
+			j.Stop()
+			return fmt.Errorf("failed to configure network: %w", err)
+		}
+		if err := updateFirewallMembers(j.config, j.Profile, true, j.IP, j.IP6); err != nil {
+			j.Stop()
+			return fmt.Errorf("failed to add jail to profile firewall: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (j *Jail) waitAgent() error {
+	socket := path.Join(j.dir, jailAgentDir, agentSocket)
+	timeout := time.After(agentStartTimeout)
+	for {
+		if pid, err := AgentPID(socket); err == nil {
+			if err := j.checkAgent(pid); err != nil {
+				j.Stop()
+				return err
+			}
+
+			j.pid = pid
+			return nil
+		}
+
+		select {
+		case <-j.done:
+			return errors.New("nsjail exited before agent started")
+		case <-timeout:
+			j.Stop()
+			return errors.New("timed out waiting for agent to start")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// checkAgent makes sure the process listening on the agent socket is the agent (started by the agent's init, which
+// is nsjail's child), since the socket's directory can be written to from inside the jail. Sessions are only passed
+// to this process from then on (see Exec()).
+func (j *Jail) checkAgent(pid int) error {
+	init, err := parentPID(pid)
+	if err != nil {
+		return fmt.Errorf("failed to get parent of agent: %w", err)
+	}
+	nsjail, err := parentPID(init)
+	if err != nil {
+		return fmt.Errorf("failed to get parent of agent init: %w", err)
+	}
+
+	if nsjail != j.cmd.Process.Pid {
+		return fmt.Errorf("agent socket belongs to process %v, which wasn't started by nsjail", pid)
+	}
+	return nil
+}
+
+// SetToken (re-)writes the CLI configuration in the jail with a new IAM token
+func (j *Jail) SetToken(token string) error {
+	cfg := make(map[string]interface{}, len(cliConfig)+1)
+	for k, v := range cliConfig {
+		cfg[k] = v
+	}
+	cfg["token"] = token
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode CLI config: %w", err)
+	}
+
+	// The jail's user owns the file so the CLI can update it
+	if err := j.writeFile("netsoc.yaml", data, 0o600, true); err != nil {
+		return fmt.Errorf("failed to write CLI config: %w", err)
+	}
+
+	return nil
+}
+
+// writeFile writes a file in the jail's directory. Files are written in place since they may be bind mounted into
+// the jail. If owned is set, the file is given to the jail's user (only its contents can be changed from inside the
+// jail, since the directory belongs to root).
+func (j *Jail) writeFile(name string, data []byte, perm os.FileMode, owned bool) error {
+	f, err := os.OpenFile(path.Join(j.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|unix.O_NOFOLLOW, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if owned {
+		if err := f.Chown(int(j.config.UIDStart), int(j.config.GIDStart)); err != nil {
+			return fmt.Errorf("failed to set ownership: %w", err)
+		}
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Exec starts a process inside the jail
+func (j *Jail) Exec(req AgentRequest, stdin, stdout, stderr *os.File) (*AgentProcess, error) {
+	return ExecAgent(path.Join(j.dir, jailAgentDir, agentSocket), j.pid, req, stdin, stdout, stderr)
+}
+
+// Done returns a channel which is closed when the jail exits
+func (j *Jail) Done() <-chan struct{} {
+	return j.done
+}
+
+// Stop kills the jail and cleans up after it
+func (j *Jail) Stop() error {
+	defer os.RemoveAll(j.dir)
+	defer func() {
+		if err := j.unshape(); err != nil {
+			log.WithError(err).WithField("user", j.User.Username).Warn("Failed to remove jail traffic shaping")
+		}
+		if err := updateFirewallMembers(j.config, j.Profile, false, j.IP, j.IP6); err != nil {
+			log.WithError(err).WithField("user", j.User.Username).Warn("Failed to remove jail from profile firewall")
+		}
+	}()
+
+	select {
+	case <-j.done:
+		return nil
+	default:
+	}
+
+	// Take a final sample while the jail's cgroups and network namespace still exist
+	j.sampleUsage(true)
+
+	if err := j.cmd.Process.Signal(unix.SIGTERM); err != nil {
+		return fmt.Errorf("failed to signal nsjail: %w", err)
+	}
+
+	select {
+	case <-j.done:
+	case <-time.After(5 * time.Second):
+		if err := j.cmd.Process.Kill(); err != nil {
+			return fmt.Errorf("failed to kill nsjail: %w", err)
+		}
+		<-j.done
+	}
+
+	return nil
+}
+
+// inNetns runs f with a netlink handle in the jail's network namespace and the jail's interface
+func (j *Jail) inNetns(f func(h *netlink.Handle, link netlink.Link) error) error {
+	ns, err := netns.GetFromPid(j.pid)
+	if err != nil {
+		return fmt.Errorf("failed to get jail network namespace: %w", err)
+	}
+	defer ns.Close()
+
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf("failed to get netlink handle in jail network namespace: %w", err)
+	}
+	defer h.Delete()
+
+	link, err := h.LinkByName(jailIface)
+	if err != nil {
+		return fmt.Errorf("failed to get jail interface: %w", err)
+	}
+
+	return f(h, link)
+}
+
+// configureNetwork applies the parts of the jail's network configuration that nsjail can't: IPv6 (nsjail's macvlan
+// configuration only supports IPv4) and traffic shaping
+func (j *Jail) configureNetwork(bw Bandwidth) error {
+	if j.IP6 != nil {
+		if err := j.inNetns(func(h *netlink.Handle, link netlink.Link) error {
+			if err := h.AddrAdd(link, &netlink.Addr{
+				IPNet: &net.IPNet{IP: j.IP6, Mask: j.config.Network.Address6.Mask},
+				Flags: unix.IFA_F_NODAD,
+			}); err != nil {
+				return fmt.Errorf("failed to add IPv6 address: %w", err)
+			}
+			if err := h.RouteAdd(&netlink.Route{
+				LinkIndex: link.Attrs().Index,
+				Gw:        j.config.Network.Address6.IP,
+			}); err != nil {
+				return fmt.Errorf("failed to add IPv6 default route: %w", err)
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return j.shape(bw)
+}
+
+// shape applies traffic shaping to the jail
+func (j *Jail) shape(bw Bandwidth) error {
+	if bw.Ingress != 0 {
+		if err := j.shapeIngress(bw.Ingress); err != nil {
+			return fmt.Errorf("failed to limit ingress bandwidth: %w", err)
+		}
+	}
+
+	if bw.Egress != 0 {
+		if err := j.inNetns(func(h *netlink.Handle, link netlink.Link) error {
+			return j.shapeEgress(h, link, bw.Egress)
+		}); err != nil {
+			return fmt.Errorf("failed to limit egress bandwidth: %w", err)
+		}
+	}
+
+	return nil
 }
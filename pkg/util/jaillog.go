@@ -0,0 +1,89 @@
+package util
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// regexNsjailLog matches nsjail's log lines, e.g. `[I][2021-04-10T13:11:03+0000] Mode: STANDALONE_ONCE` or (at
+// debug level) `[D][2021-04-10T13:11:03+0000][1234] setupFD():49 ...`
+var regexNsjailLog = regexp.MustCompile(`^\[([A-Z!])\]\[([^\]]+)\](?:\[(\d+)\])? ?(.*)$`)
+
+var nsjailLogLevelChars = map[string]log.Level{
+	"D": log.DebugLevel,
+	"I": log.InfoLevel,
+	"W": log.WarnLevel,
+	"E": log.ErrorLevel,
+	// nsjail's fatal messages shouldn't bring down shhd
+	"F": log.ErrorLevel,
+}
+
+// JailLogLine is a parsed line of a jail's nsjail log
+type JailLogLine struct {
+	Level log.Level
+	// Time is nsjail's timestamp for the line (as formatted by nsjail)
+	Time string
+	// PID is the PID which logged the line (0 if not included)
+	PID     int
+	Message string
+}
+
+// parseNsjailLog parses a line of nsjail's log output, treating lines not in the expected format as warnings
+func parseNsjailLog(line string) JailLogLine {
+	m := regexNsjailLog.FindStringSubmatch(line)
+	if m == nil {
+		return JailLogLine{Level: log.WarnLevel, Message: line}
+	}
+
+	l := JailLogLine{Level: log.WarnLevel, Time: m[2], Message: m[4]}
+	if level, ok := nsjailLogLevelChars[m[1]]; ok {
+		l.Level = level
+	}
+	if m[3] != "" {
+		l.PID, _ = strconv.Atoi(m[3])
+	}
+
+	return l
+}
+
+type jailLog struct {
+	sync.Mutex
+	onLog func(JailLogLine)
+}
+
+// OnLog sets a function to be called for each line nsjail logs (in addition to the debug log)
+func (j *Jail) OnLog(f func(JailLogLine)) {
+	j.logs.Lock()
+	defer j.logs.Unlock()
+
+	j.logs.onLog = f
+}
+
+// copyLog parses nsjail's log output from r until EOF
+func (j *Jail) copyLog(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := parseNsjailLog(scanner.Text())
+
+		j.logs.Lock()
+		onLog := j.logs.onLog
+		username := j.User.Username
+		j.logs.Unlock()
+
+		log.WithFields(log.Fields{
+			"user": username,
+			"pid":  l.PID,
+		}).Log(l.Level, "nsjail: "+l.Message)
+		if onLog != nil {
+			onLog(l)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.WithError(err).Warn("Failed to read nsjail log")
+	}
+}
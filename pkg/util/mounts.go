@@ -0,0 +1,113 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mount represents a filesystem mount in jails
+type Mount struct {
+	// Src is the host path for bind mounts (or the source for other filesystem types)
+	Src string
+	Dst string
+	// Type is the filesystem type, or empty for a bind mount
+	Type    string
+	Options string
+	RW      bool `mapstructure:"rw"`
+	// Optional bind mounts are skipped if their source doesn't exist
+	Optional bool
+}
+
+// defaultMounts are mounted in every jail unless overridden by a configured mount with the same destination
+var defaultMounts = []Mount{
+	{Src: "/lib", Dst: "/lib"},
+	{Src: "/lib64", Dst: "/lib64", Optional: true},
+	{Src: "/bin", Dst: "/bin"},
+	{Src: "/sbin", Dst: "/sbin", Optional: true},
+	{Src: "/usr", Dst: "/usr"},
+
+	{Src: "/etc/shells", Dst: "/etc/shells", Optional: true},
+	{Src: "/etc/terminfo", Dst: "/etc/terminfo", Optional: true},
+	{Src: "/etc/fish", Dst: "/etc/fish", Optional: true},
+	{Src: "/etc/ssl", Dst: "/etc/ssl", Optional: true},
+	{Src: "/etc/man_db.conf", Dst: "/etc/man_db.conf", Optional: true},
+	{Src: "/var/cache/man", Dst: "/var/cache/man", Optional: true},
+
+	{Dst: "/tmp", Type: "tmpfs", Options: "size=8388608", RW: true},
+}
+
+// jailMounts are the validated lists of mounts for jails, by profile name (empty for users without a profile)
+var jailMounts map[string][]Mount
+
+// mergeMounts overlays configured mounts on top of a base list
+func mergeMounts(base, configured []Mount) []Mount {
+	mounts := make([]Mount, len(base))
+	copy(mounts, base)
+
+outer:
+	for _, m := range configured {
+		for i := range mounts {
+			if path.Clean(mounts[i].Dst) == path.Clean(m.Dst) {
+				mounts[i] = m
+				continue outer
+			}
+		}
+
+		mounts = append(mounts, m)
+	}
+
+	return mounts
+}
+
+func checkMounts(merged []Mount) ([]Mount, error) {
+	var mounts []Mount
+	for _, m := range merged {
+		if !path.IsAbs(m.Dst) {
+			return nil, fmt.Errorf("mount destination %v is not absolute", m.Dst)
+		}
+
+		if m.Type == "" {
+			if !path.IsAbs(m.Src) {
+				return nil, fmt.Errorf("bind mount source %v for %v is not absolute", m.Src, m.Dst)
+			}
+
+			if _, err := os.Stat(m.Src); err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					return nil, fmt.Errorf("error stat'ing bind mount source %v: %w", m.Src, err)
+				}
+				if !m.Optional {
+					return nil, fmt.Errorf("bind mount source %v for %v does not exist", m.Src, m.Dst)
+				}
+
+				log.WithField("src", m.Src).Debug("Skipping optional jail mount with missing source")
+				continue
+			}
+		}
+
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+func initMounts(c *JailConfig) error {
+	global := mergeMounts(defaultMounts, c.Mounts)
+	mounts, err := checkMounts(global)
+	if err != nil {
+		return err
+	}
+
+	byProfile := map[string][]Mount{"": mounts}
+	for name, p := range c.Profiles {
+		if byProfile[name], err = checkMounts(mergeMounts(global, p.Mounts)); err != nil {
+			return fmt.Errorf("profile %v: %w", name, err)
+		}
+	}
+
+	jailMounts = byProfile
+	return nil
+}
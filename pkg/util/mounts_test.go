@@ -0,0 +1,138 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeMounts(t *testing.T) {
+	base := []Mount{
+		{Src: "/lib", Dst: "/lib"},
+		{Src: "/usr", Dst: "/usr"},
+		{Dst: "/tmp", Type: "tmpfs", Options: "size=8388608", RW: true},
+	}
+
+	tests := []struct {
+		name       string
+		configured []Mount
+		want       []Mount
+	}{
+		{"none", nil, base},
+		{
+			name:       "appended",
+			configured: []Mount{{Src: "/srv/data", Dst: "/data", Optional: true}},
+			want:       append(append([]Mount{}, base...), Mount{Src: "/srv/data", Dst: "/data", Optional: true}),
+		},
+		{
+			name:       "replaced in place",
+			configured: []Mount{{Dst: "/tmp", Type: "tmpfs", Options: "size=67108864", RW: true}},
+			want: []Mount{
+				{Src: "/lib", Dst: "/lib"},
+				{Src: "/usr", Dst: "/usr"},
+				{Dst: "/tmp", Type: "tmpfs", Options: "size=67108864", RW: true},
+			},
+		},
+		{
+			name:       "destinations are compared cleaned",
+			configured: []Mount{{Src: "/opt/usr", Dst: "/usr/"}, {Src: "/opt/lib", Dst: "//lib/../lib"}},
+			want: []Mount{
+				{Src: "/opt/lib", Dst: "//lib/../lib"},
+				{Src: "/opt/usr", Dst: "/usr/"},
+				{Dst: "/tmp", Type: "tmpfs", Options: "size=8388608", RW: true},
+			},
+		},
+		{
+			name:       "later configured mounts replace earlier ones",
+			configured: []Mount{{Src: "/a", Dst: "/data"}, {Src: "/b", Dst: "/data"}},
+			want:       append(append([]Mount{}, base...), Mount{Src: "/b", Dst: "/data"}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeMounts(base, tt.configured); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeMounts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if base[2].Options != "size=8388608" {
+		t.Errorf("mergeMounts() modified the base mounts: %+v", base)
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	dir := t.TempDir()
+	exists := filepath.Join(dir, "exists")
+	if err := os.Mkdir(exists, 0o755); err != nil {
+		t.Fatalf("failed to create %v: %v", exists, err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	tests := []struct {
+		name    string
+		mounts  []Mount
+		want    []Mount
+		wantErr bool
+	}{
+		{
+			name:   "bind mount",
+			mounts: []Mount{{Src: exists, Dst: "/data"}},
+			want:   []Mount{{Src: exists, Dst: "/data"}},
+		},
+		{
+			name: "optional missing source skipped",
+			mounts: []Mount{
+				{Src: missing, Dst: "/missing", Optional: true},
+				{Src: exists, Dst: "/data", Optional: true},
+			},
+			want: []Mount{{Src: exists, Dst: "/data", Optional: true}},
+		},
+		{
+			name:   "other filesystems aren't stat'd",
+			mounts: []Mount{{Src: "none", Dst: "/tmp", Type: "tmpfs", RW: true}},
+			want:   []Mount{{Src: "none", Dst: "/tmp", Type: "tmpfs", RW: true}},
+		},
+		{
+			name:    "missing source",
+			mounts:  []Mount{{Src: missing, Dst: "/missing"}},
+			wantErr: true,
+		},
+		{
+			name:    "relative destination",
+			mounts:  []Mount{{Src: exists, Dst: "data"}},
+			wantErr: true,
+		},
+		{
+			name:    "relative destination for other filesystem",
+			mounts:  []Mount{{Dst: "tmp", Type: "tmpfs"}},
+			wantErr: true,
+		},
+		{
+			name:    "relative source",
+			mounts:  []Mount{{Src: "exists", Dst: "/data", Optional: true}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkMounts(tt.mounts)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("checkMounts() = %+v, want error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("checkMounts() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkMounts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
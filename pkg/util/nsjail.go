@@ -0,0 +1,248 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// nsjailLogLevels are the values of nsjail's LogLevel enum
+var nsjailLogLevels = map[string]struct{}{
+	"DEBUG":   {},
+	"INFO":    {},
+	"WARNING": {},
+	"ERROR":   {},
+	"FATAL":   {},
+}
+
+// nsjailIDMap mirrors nsjail's IdMap message
+type nsjailIDMap struct {
+	InsideID  string
+	OutsideID string
+}
+
+// nsjailMount mirrors nsjail's MountPt message
+type nsjailMount struct {
+	Src        string
+	SrcContent []byte
+	Dst        string
+	Fstype     string
+	Options    string
+	IsBind     bool
+	RW         bool
+	IsSymlink  bool
+}
+
+// nsjailExe mirrors nsjail's Exe message
+type nsjailExe struct {
+	Path string
+	Arg0 string
+	Args []string
+}
+
+// nsjailConfig mirrors the subset of nsjail's NsJailConfig message which shhd uses
+type nsjailConfig struct {
+	Name        string
+	Description string
+	Hostname    string
+	Cwd         string
+
+	MaxCPUs  uint32
+	LogFD    int32
+	LogLevel string
+
+	KeepEnv    bool
+	Caps       []string
+	SkipSetsid bool
+
+	CgroupParent      string
+	CgroupMemMax      uint64
+	CgroupPidsMax     uint64
+	CgroupCPUMsPerSec uint32
+
+	UIDMap []nsjailIDMap
+	GIDMap []nsjailIDMap
+	Mounts []nsjailMount
+
+	SeccompString []string
+	SeccompLog    bool
+
+	MacvlanIface string
+	MacvlanVsIP  string
+	MacvlanVsNm  string
+	MacvlanVsGw  string
+
+	ExecBin nsjailExe
+}
+
+// quoteProto quotes data as a protobuf text format string literal, escaping everything outside of printable ASCII
+func quoteProto(data []byte) string {
+	b := make([]byte, 0, len(data)+2)
+	b = append(b, '"')
+	for _, c := range data {
+		switch c {
+		case '"', '\'', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		default:
+			if c < 0x20 || c >= 0x7f {
+				b = append(b, '\\', '0'+(c>>6), '0'+((c>>3)&7), '0'+(c&7))
+			} else {
+				b = append(b, c)
+			}
+		}
+	}
+	b = append(b, '"')
+
+	return string(b)
+}
+
+// protoWriter writes messages in protobuf text format
+type protoWriter struct {
+	b      bytes.Buffer
+	indent int
+}
+
+func (w *protoWriter) field(name, value string) {
+	for i := 0; i < w.indent; i++ {
+		w.b.WriteByte('\t')
+	}
+	fmt.Fprintf(&w.b, "%v: %v\n", name, value)
+}
+
+func (w *protoWriter) str(name, v string) {
+	w.field(name, quoteProto([]byte(v)))
+}
+
+// optStr writes a string field only if it isn't empty
+func (w *protoWriter) optStr(name, v string) {
+	if v != "" {
+		w.str(name, v)
+	}
+}
+
+func (w *protoWriter) bytes(name string, v []byte) {
+	w.field(name, quoteProto(v))
+}
+
+func (w *protoWriter) uint(name string, v uint64) {
+	w.field(name, strconv.FormatUint(v, 10))
+}
+
+func (w *protoWriter) int(name string, v int64) {
+	w.field(name, strconv.FormatInt(v, 10))
+}
+
+func (w *protoWriter) bool(name string, v bool) {
+	w.field(name, strconv.FormatBool(v))
+}
+
+func (w *protoWriter) message(name string, f func()) {
+	for i := 0; i < w.indent; i++ {
+		w.b.WriteByte('\t')
+	}
+	fmt.Fprintf(&w.b, "%v {\n", name)
+
+	w.indent++
+	f()
+	w.indent--
+
+	for i := 0; i < w.indent; i++ {
+		w.b.WriteByte('\t')
+	}
+	w.b.WriteString("}\n")
+}
+
+// marshal serialises the config in protobuf text format (as read by nsjail --config)
+func (c *nsjailConfig) marshal() ([]byte, error) {
+	// Enum values can't be quoted, so they must be checked
+	if _, ok := nsjailLogLevels[c.LogLevel]; !ok {
+		return nil, fmt.Errorf("unknown nsjail log level %q", c.LogLevel)
+	}
+
+	w := &protoWriter{}
+	w.str("name", c.Name)
+	w.str("description", c.Description)
+	w.field("mode", "ONCE")
+	w.str("hostname", c.Hostname)
+	w.str("cwd", c.Cwd)
+
+	w.uint("time_limit", 0)
+	w.bool("daemon", false)
+	w.uint("max_cpus", uint64(c.MaxCPUs))
+
+	w.int("log_fd", int64(c.LogFD))
+	w.field("log_level", c.LogLevel)
+
+	w.bool("keep_env", c.KeepEnv)
+	for _, capability := range c.Caps {
+		w.str("cap", capability)
+	}
+	w.bool("skip_setsid", c.SkipSetsid)
+
+	w.str("cgroup_mem_parent", c.CgroupParent)
+	w.str("cgroup_pids_parent", c.CgroupParent)
+	w.str("cgroup_cpu_parent", c.CgroupParent)
+	w.uint("cgroup_mem_max", c.CgroupMemMax)
+	w.uint("cgroup_pids_max", c.CgroupPidsMax)
+	w.uint("cgroup_cpu_ms_per_sec", uint64(c.CgroupCPUMsPerSec))
+
+	for _, m := range c.UIDMap {
+		w.message("uidmap", func() {
+			w.str("inside_id", m.InsideID)
+			w.str("outside_id", m.OutsideID)
+		})
+	}
+	for _, m := range c.GIDMap {
+		w.message("gidmap", func() {
+			w.str("inside_id", m.InsideID)
+			w.str("outside_id", m.OutsideID)
+		})
+	}
+
+	for _, m := range c.Mounts {
+		w.message("mount", func() {
+			w.optStr("src", m.Src)
+			if m.SrcContent != nil {
+				w.bytes("src_content", m.SrcContent)
+			}
+			w.str("dst", m.Dst)
+			w.optStr("fstype", m.Fstype)
+			w.optStr("options", m.Options)
+			w.bool("is_bind", m.IsBind)
+			w.bool("rw", m.RW)
+			if m.IsSymlink {
+				w.bool("is_symlink", true)
+			}
+		})
+	}
+
+	for _, s := range c.SeccompString {
+		w.str("seccomp_string", s)
+	}
+	if c.SeccompLog {
+		w.bool("seccomp_log", true)
+	}
+
+	if c.MacvlanIface != "" {
+		w.str("macvlan_iface", c.MacvlanIface)
+		w.str("macvlan_vs_ip", c.MacvlanVsIP)
+		w.str("macvlan_vs_nm", c.MacvlanVsNm)
+		w.str("macvlan_vs_gw", c.MacvlanVsGw)
+	}
+
+	w.message("exec_bin", func() {
+		w.str("path", c.ExecBin.Path)
+		w.str("arg0", c.ExecBin.Arg0)
+		for _, a := range c.ExecBin.Args {
+			w.str("arg", a)
+		}
+	})
+
+	return w.b.Bytes(), nil
+}
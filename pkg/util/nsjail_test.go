@@ -0,0 +1,369 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	iam "github.com/netsoc/iam/client"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// protoField is a field parsed from protobuf text format (Value is unquoted for strings, Fields is set for messages)
+type protoField struct {
+	Name   string
+	Value  string
+	Quoted bool
+	Fields []protoField
+}
+
+// protoParser is a minimal strict parser for the subset of protobuf text format written by protoWriter
+type protoParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *protoParser) skipSpace() {
+	for p.pos < len(p.data) && strings.IndexByte(" \t\n", p.data[p.pos]) != -1 {
+		p.pos++
+	}
+}
+
+func (p *protoParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %v: %v", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *protoParser) ident() (string, error) {
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected identifier")
+	}
+
+	return string(p.data[start:p.pos]), nil
+}
+
+func (p *protoParser) quoted() (string, error) {
+	p.pos++
+	var b []byte
+	for {
+		if p.pos >= len(p.data) {
+			return "", p.errorf("unterminated string")
+		}
+
+		c := p.data[p.pos]
+		p.pos++
+		switch {
+		case c == '"':
+			return string(b), nil
+		case c == '\n':
+			return "", p.errorf("newline in string")
+		case c != '\\':
+			b = append(b, c)
+			continue
+		}
+
+		if p.pos >= len(p.data) {
+			return "", p.errorf("unterminated escape")
+		}
+		e := p.data[p.pos]
+		p.pos++
+		switch e {
+		case '"', '\'', '\\':
+			b = append(b, e)
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case '0', '1', '2', '3':
+			if p.pos+2 > len(p.data) {
+				return "", p.errorf("short octal escape")
+			}
+			v := e - '0'
+			for _, d := range p.data[p.pos : p.pos+2] {
+				if d < '0' || d > '7' {
+					return "", p.errorf("invalid octal escape")
+				}
+				v = v<<3 | (d - '0')
+			}
+			p.pos += 2
+			b = append(b, v)
+		default:
+			return "", p.errorf("unknown escape \\%c", e)
+		}
+	}
+}
+
+func (p *protoParser) fields(nested bool) ([]protoField, error) {
+	var fields []protoField
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			if nested {
+				return nil, p.errorf("unterminated message")
+			}
+			return fields, nil
+		}
+		if p.data[p.pos] == '}' {
+			if !nested {
+				return nil, p.errorf("unexpected }")
+			}
+			p.pos++
+			return fields, nil
+		}
+
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("expected : or {")
+		}
+
+		f := protoField{Name: name}
+		switch p.data[p.pos] {
+		case '{':
+			p.pos++
+			if f.Fields, err = p.fields(true); err != nil {
+				return nil, err
+			}
+		case ':':
+			p.pos++
+			p.skipSpace()
+			if p.pos < len(p.data) && p.data[p.pos] == '"' {
+				f.Quoted = true
+				if f.Value, err = p.quoted(); err != nil {
+					return nil, err
+				}
+			} else if f.Value, err = p.ident(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorf("expected : or {")
+		}
+
+		fields = append(fields, f)
+	}
+}
+
+func parseProto(data []byte) ([]protoField, error) {
+	p := &protoParser{data: data}
+	return p.fields(false)
+}
+
+// flatProtoField is a field with its path from the top-level message
+type flatProtoField struct {
+	Path  string
+	Value string
+}
+
+func flattenProto(prefix string, fields []protoField) []flatProtoField {
+	var flat []flatProtoField
+	for _, f := range fields {
+		path := prefix + f.Name
+		if f.Fields != nil {
+			flat = append(flat, flatProtoField{Path: path + "{"})
+			flat = append(flat, flattenProto(path+".", f.Fields)...)
+			continue
+		}
+
+		flat = append(flat, flatProtoField{path, f.Value})
+	}
+
+	return flat
+}
+
+func TestQuoteProto(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", `""`},
+		{"plain", `"plain"`},
+		{`a "quoted" string`, `"a \"quoted\" string"`},
+		{`it's`, `"it\'s"`},
+		{`back\slash`, `"back\\slash"`},
+		{"new\nline\r\t", `"new\nline\r\t"`},
+		{"nul\x00", `"nul\000"`},
+		{"\x7f\xff", `"\177\377"`},
+		{"ünï", `"\303\274n\303\257"`},
+	}
+
+	for _, tt := range tests {
+		if got := quoteProto([]byte(tt.in)); got != tt.want {
+			t.Errorf("quoteProto(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func FuzzQuoteProto(f *testing.F) {
+	for _, s := range []string{"", "plain", `"; exec_bin { path: "/bin/sh" } x: "`, "\\\"\n}\x00\xff"} {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		q := quoteProto(data)
+		for i := 0; i < len(q); i++ {
+			if q[i] < 0x20 || q[i] >= 0x7f {
+				t.Fatalf("quoteProto(%q) contains unescaped byte %#x", data, q[i])
+			}
+		}
+
+		fields, err := parseProto([]byte("a: " + q + "\nb: true\n"))
+		if err != nil {
+			t.Fatalf("failed to parse quoted %q: %v", data, err)
+		}
+		if len(fields) != 2 || fields[0].Name != "a" || fields[1].Name != "b" {
+			t.Fatalf("quoted %q parsed as %+v", data, fields)
+		}
+		if fields[0].Value != string(data) {
+			t.Fatalf("quoted %q parsed as %q", data, fields[0].Value)
+		}
+
+		// The test parser could share a bug with the writer, so also check the output with the protobuf library's
+		// parser (string fields must be valid UTF-8 in proto3, but bytes fields are quoted the same way)
+		var b wrapperspb.BytesValue
+		if err := prototext.Unmarshal([]byte("value: "+q), &b); err != nil {
+			t.Fatalf("prototext failed to parse quoted %q: %v", data, err)
+		}
+		if !bytes.Equal(b.Value, data) {
+			t.Fatalf("prototext parsed quoted %q as %q", data, b.Value)
+		}
+		if utf8.Valid(data) {
+			var s wrapperspb.StringValue
+			if err := prototext.Unmarshal([]byte("value: "+q), &s); err != nil {
+				t.Fatalf("prototext failed to parse quoted %q as a string: %v", data, err)
+			}
+			if s.Value != string(data) {
+				t.Fatalf("prototext parsed quoted %q as %q", data, s.Value)
+			}
+		}
+	})
+}
+
+// testJailInfo returns the info for a (non-pooled) jail for a user
+func testJailInfo(t testing.TB, username string) *jailInfo {
+	c := &JailConfig{
+		TmpDir:   "/tmp/shh",
+		LogLevel: "WARNING",
+		UIDStart: 100000,
+		GIDStart: 100000,
+		HomeSize: 1024,
+		Greeting: "Hello",
+		Shells:   map[string]string{"sh": "/bin/sh"},
+		Shell:    "sh",
+	}
+	c.Network.Interface = "nsjail"
+	c.Network.Address = net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(16, 32)}
+
+	info, err := newJailInfo(c, &iam.User{Username: username}, "/tmp/shh/jails/"+username+"-123", "/usr/bin/shhd",
+		JailOptions{Path: "/usr/bin:/bin", IP: net.IPv4(192, 168, 0, 2)}, false)
+	if err != nil {
+		t.Fatalf("failed to create jail info: %v", err)
+	}
+
+	return info
+}
+
+// renderTestJail renders the nsjail config for a user's jail, with an extra exec_bin argument (commands are run by
+// the agent rather than passed to nsjail, but they must not be able to escape their field either)
+func renderTestJail(t testing.TB, username, command string) []flatProtoField {
+	cfg := testJailInfo(t, username).nsjailConfig()
+	cfg.ExecBin.Args = append(cfg.ExecBin.Args, command)
+
+	data, err := cfg.marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal config: %v", err)
+	}
+	fields, err := parseProto(data)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v\n%s", err, data)
+	}
+
+	return flattenProto("", fields)
+}
+
+func TestNsjailConfigFields(t *testing.T) {
+	fields := renderTestJail(t, "alice", "COMMAND")
+
+	values := map[string][]string{}
+	for _, f := range fields {
+		values[f.Path] = append(values[f.Path], f.Value)
+	}
+
+	want := map[string]string{
+		"name":              "shhd-alice",
+		"hostname":          "alice-netsoc",
+		"cwd":               "/home/alice",
+		"log_level":         "WARNING",
+		"uidmap.inside_id":  "0",
+		"uidmap.outside_id": "100000",
+		"gidmap.inside_id":  "0",
+		"gidmap.outside_id": "100000",
+		"macvlan_iface":     "nsjail-jail",
+		"macvlan_vs_ip":     "192.168.0.2",
+		"macvlan_vs_nm":     "255.255.0.0",
+		"macvlan_vs_gw":     "192.168.0.1",
+		"exec_bin.path":     agentBin,
+		"exec_bin.arg0":     "shhd",
+	}
+	for path, v := range want {
+		if got := values[path]; len(got) != 1 || got[0] != v {
+			t.Errorf("%v = %q, want [%q]", path, got, v)
+		}
+	}
+
+	args := values["exec_bin.arg"]
+	wantArgs := []string{AgentCommand, agentDir + "/" + agentSocket, "COMMAND"}
+	if strings.Join(args, "\x00") != strings.Join(wantArgs, "\x00") {
+		t.Errorf("exec_bin args = %q, want %q", args, wantArgs)
+	}
+}
+
+func FuzzNsjailConfig(f *testing.F) {
+	for _, s := range [][2]string{
+		{"bob", "ls -la"},
+		{`eve"`, `"; exec_bin { path: "/bin/sh" } arg: "`},
+		{"mallory\\", "\\\"\n}\nrw: true\n"},
+		{"ünï", "\x00\xff"},
+	} {
+		f.Add(s[0], s[1])
+	}
+
+	base := renderTestJail(f, "alice", "COMMAND")
+	f.Fuzz(func(t *testing.T, username, command string) {
+		// StartJail() rejects these (and path.Join() would clean up the home directory)
+		if checkUsername(username) != nil || strings.Contains(username, "..") {
+			t.Skip()
+		}
+
+		fields := renderTestJail(t, username, command)
+		if len(fields) != len(base) {
+			t.Fatalf("config for %q / %q has %v fields, want %v", username, command, len(fields), len(base))
+		}
+
+		// Only the values derived from the username and command can differ
+		r := strings.NewReplacer("alice", username, "COMMAND", command)
+		for i, f := range fields {
+			if f.Path != base[i].Path {
+				t.Fatalf("field %v is %v, want %v", i, f.Path, base[i].Path)
+			}
+			if want := r.Replace(base[i].Value); f.Value != want {
+				t.Fatalf("%v = %q, want %q", f.Path, f.Value, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	iam "github.com/netsoc/iam/client"
+)
+
+// pooledHostname is the hostname of pooled jails (which can't be changed once the jail has started)
+const pooledHostname = "shh-netsoc"
+
+// poolUser is a placeholder for the user of pooled jails which haven't been claimed yet
+var poolUser = &iam.User{Username: "shh-pool"}
+
+// ClaimOptions represents the per-user settings applied to a pooled jail when it is claimed
+type ClaimOptions struct {
+	// Token is the IAM token for the CLI
+	Token string
+	// Shell is the name of the user's login shell (the default if empty)
+	Shell string
+
+	Bandwidth Bandwidth
+}
+
+// StartPooledJail starts a generic jail which can be claimed by a user later on. Only users without a profile can
+// claim pooled jails, and persistent home directories are not supported.
+func StartPooledJail(c *JailConfig, opts JailOptions) (*Jail, error) {
+	if c.Home.Backend != HomeBackendTmpfs {
+		return nil, fmt.Errorf("pooled jails are not supported with the %v home backend", c.Home.Backend)
+	}
+
+	opts.Home = ""
+	opts.Profile = ""
+	return newJail(c, poolUser, "pool", opts, true)
+}
+
+// writeIdentity (re-)writes the jail's passwd and group files (only for pooled jails)
+func (j *Jail) writeIdentity(u *iam.User, shell string) error {
+	passwd := fmt.Sprintf("%v:x:0:0::%v:%v\n", u.Username, path.Join("/home", u.Username), shell)
+	if err := j.writeFile("passwd", []byte(passwd), 0o644, false); err != nil {
+		return fmt.Errorf("failed to write passwd: %w", err)
+	}
+
+	group := fmt.Sprintf("%v:x:0:\n", u.Username)
+	if err := j.writeFile("group", []byte(group), 0o644, false); err != nil {
+		return fmt.Errorf("failed to write group: %w", err)
+	}
+
+	return nil
+}
+
+// run runs a command in the jail to completion (without any input or output)
+func (j *Jail) run(argv ...string) error {
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", os.DevNull, err)
+	}
+	defer null.Close()
+
+	proc, err := j.Exec(AgentRequest{Argv: argv}, null, null, null)
+	if err != nil {
+		return err
+	}
+
+	code, err := proc.Wait()
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return fmt.Errorf("%v exited with code %v", argv[0], code)
+	}
+
+	return nil
+}
+
+// Claim personalises a pooled jail for a user
+func (j *Jail) Claim(u *iam.User, opts ClaimOptions) error {
+	if j.User != poolUser {
+		return errors.New("jail is not pooled or has already been claimed")
+	}
+	if err := checkUsername(u.Username); err != nil {
+		return err
+	}
+
+	shell := opts.Shell
+	if shell == "" {
+		shell = j.config.Shell
+	}
+	shellPath, err := j.config.ShellPath(shell)
+	if err != nil {
+		return err
+	}
+
+	if err := j.writeIdentity(u, shellPath); err != nil {
+		return err
+	}
+	if err := j.SetToken(opts.Token); err != nil {
+		return err
+	}
+
+	home := path.Join("/home", u.Username)
+	if err := j.run("/bin/mkdir", "-p", "-m", "0700", home); err != nil {
+		return fmt.Errorf("failed to create home directory: %w", err)
+	}
+	if err := j.run("/bin/ln", "-sf", cliConfigFile, path.Join(home, ".netsoc.yaml")); err != nil {
+		return fmt.Errorf("failed to link CLI config: %w", err)
+	}
+
+	if j.config.Network.Interface != "" {
+		if err := j.shape(opts.Bandwidth); err != nil {
+			return fmt.Errorf("failed to configure traffic shaping: %w", err)
+		}
+	}
+
+	// The log copier reads the user to attribute nsjail's log lines
+	j.logs.Lock()
+	j.User = u
+	j.logs.Unlock()
+	return nil
+}
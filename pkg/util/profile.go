@@ -0,0 +1,152 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	iam "github.com/netsoc/iam/client"
+)
+
+var profileNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// Profile overrides jail settings for users matched by a ProfileRule (zero values inherit the global setting)
+type Profile struct {
+	Cgroups struct {
+		Memory  uint64
+		PIDs    uint64
+		CPUTime uint32 `mapstructure:"cpu_time"`
+	} `mapstructure:"cgroups"`
+
+	HomeSize uint64 `mapstructure:"home_size"`
+	// Mounts are merged on top of the global mounts
+	Mounts []Mount
+	Shell  string
+	// SessionDuration is the maximum length of a session
+	SessionDuration time.Duration `mapstructure:"session_duration"`
+
+	Network struct {
+		Firewall struct {
+			// Allow rules are evaluated in addition to the global ones
+			Allow []FirewallRule
+			// Default overrides the global default action
+			Default string
+		}
+		// Bandwidth replaces the global (and per-group) limits if set
+		Bandwidth *Bandwidth
+	}
+}
+
+// hasFirewall returns true if the profile has its own firewall policy
+func (p *Profile) hasFirewall() bool {
+	return len(p.Network.Firewall.Allow) != 0 || p.Network.Firewall.Default != ""
+}
+
+// ProfileRule selects a profile for users with one of the listed usernames or groups (see UserGroups())
+type ProfileRule struct {
+	Users   []string
+	Groups  []string
+	Profile string
+}
+
+func (r *ProfileRule) matches(u *iam.User) bool {
+	for _, name := range r.Users {
+		if name == u.Username {
+			return true
+		}
+	}
+
+	for _, g := range UserGroups(u) {
+		for _, rg := range r.Groups {
+			if rg == g {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// profileNames returns the names of configured profiles in a stable order
+func (c *JailConfig) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func checkProfiles(c *JailConfig) error {
+	for name, p := range c.Profiles {
+		if !profileNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid profile name %q (must match %v)", name, profileNameRegex)
+		}
+
+		if p.Shell != "" {
+			if _, ok := c.Shells[p.Shell]; !ok {
+				return fmt.Errorf("unknown shell %v for profile %v", p.Shell, name)
+			}
+		}
+
+		fw := &p.Network.Firewall
+		if fw.Default != "" && fw.Default != "accept" && fw.Default != "drop" {
+			return fmt.Errorf("unknown default firewall action %v for profile %v", fw.Default, name)
+		}
+		for _, r := range fw.Allow {
+			if _, err := r.match(); err != nil {
+				return fmt.Errorf("invalid firewall rule for %v in profile %v: %w", r.Destination, name, err)
+			}
+		}
+	}
+
+	for i, r := range c.ProfileRules {
+		if _, ok := c.Profiles[r.Profile]; !ok {
+			return fmt.Errorf("profile rule %v refers to unknown profile %q", i, r.Profile)
+		}
+	}
+
+	return nil
+}
+
+// ForUser returns the name of the profile which applies to a user (empty if there is none) and the jail
+// configuration with the profile's overrides applied
+func (c *JailConfig) ForUser(u *iam.User) (string, *JailConfig) {
+	for _, r := range c.ProfileRules {
+		if r.matches(u) {
+			return r.Profile, c.withProfile(c.Profiles[r.Profile])
+		}
+	}
+
+	return "", c
+}
+
+func (c *JailConfig) withProfile(p Profile) *JailConfig {
+	merged := *c
+
+	if p.Cgroups.Memory != 0 {
+		merged.Cgroups.Memory = p.Cgroups.Memory
+	}
+	if p.Cgroups.PIDs != 0 {
+		merged.Cgroups.PIDs = p.Cgroups.PIDs
+	}
+	if p.Cgroups.CPUTime != 0 {
+		merged.Cgroups.CPUTime = p.Cgroups.CPUTime
+	}
+	if p.HomeSize != 0 {
+		merged.HomeSize = p.HomeSize
+	}
+	if p.Shell != "" {
+		merged.Shell = p.Shell
+	}
+	if p.SessionDuration != 0 {
+		merged.SessionDuration = p.SessionDuration
+	}
+	if p.Network.Bandwidth != nil {
+		merged.Network.Bandwidth = BandwidthConfig{Bandwidth: *p.Network.Bandwidth}
+	}
+
+	return &merged
+}
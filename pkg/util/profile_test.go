@@ -0,0 +1,136 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	iam "github.com/netsoc/iam/client"
+)
+
+func testProfileConfig() *JailConfig {
+	c := &JailConfig{
+		HomeSize:        1024,
+		Shell:           "fish",
+		SessionDuration: time.Hour,
+	}
+	c.Cgroups.Memory = 128
+	c.Cgroups.PIDs = 64
+	c.Cgroups.CPUTime = 200
+	c.Network.Bandwidth = BandwidthConfig{
+		Bandwidth: Bandwidth{Egress: 10, Ingress: 50},
+		Groups:    map[string]Bandwidth{"admin": {}},
+	}
+
+	staff := Profile{HomeSize: 4096}
+	staff.Cgroups.Memory = 512
+	staff.Cgroups.PIDs = 256
+	staff.Network.Bandwidth = &Bandwidth{}
+
+	tutorial := Profile{Shell: "bash", SessionDuration: 2 * time.Hour}
+	tutorial.Cgroups.Memory = 64
+	tutorial.Cgroups.CPUTime = 100
+
+	c.Profiles = map[string]Profile{"staff": staff, "tutorial": tutorial}
+	c.ProfileRules = []ProfileRule{
+		{Groups: []string{"admin"}, Profile: "staff"},
+		{Users: []string{"tutorial1", "tutorial2"}, Groups: []string{"verified"}, Profile: "tutorial"},
+		{Users: []string{"bob"}, Profile: "staff"},
+	}
+
+	return c
+}
+
+func TestForUser(t *testing.T) {
+	yes, no := true, false
+
+	tests := []struct {
+		name    string
+		user    iam.User
+		profile string
+	}{
+		{"no match", iam.User{Username: "alice", IsAdmin: &no, Verified: &no}, ""},
+		{"nil flags", iam.User{Username: "alice"}, ""},
+		{"group", iam.User{Username: "alice", IsAdmin: &yes, Verified: &no}, "staff"},
+		{"username", iam.User{Username: "tutorial2", Verified: &no}, "tutorial"},
+		{"first matching rule wins", iam.User{Username: "tutorial1", IsAdmin: &yes, Verified: &yes}, "staff"},
+		{"group before later username", iam.User{Username: "bob", Verified: &yes}, "tutorial"},
+		{"later rule", iam.User{Username: "bob", Verified: &no}, "staff"},
+		{"usernames are exact", iam.User{Username: "tutorial"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testProfileConfig()
+			profile, got := c.ForUser(&tt.user)
+			if profile != tt.profile {
+				t.Errorf("ForUser(%v) selected profile %q, want %q", tt.user.Username, profile, tt.profile)
+			}
+			if tt.profile == "" && got != c {
+				t.Errorf("ForUser(%v) returned a modified config without a profile", tt.user.Username)
+			}
+		})
+	}
+}
+
+func TestWithProfile(t *testing.T) {
+	c := testProfileConfig()
+
+	tests := []struct {
+		profile         string
+		memory          uint64
+		pids            uint64
+		cpuTime         uint32
+		homeSize        uint64
+		shell           string
+		sessionDuration time.Duration
+		bandwidth       BandwidthConfig
+	}{
+		{
+			profile:         "staff",
+			memory:          512,
+			pids:            256,
+			cpuTime:         200,
+			homeSize:        4096,
+			shell:           "fish",
+			sessionDuration: time.Hour,
+			bandwidth:       BandwidthConfig{},
+		},
+		{
+			profile:         "tutorial",
+			memory:          64,
+			pids:            64,
+			cpuTime:         100,
+			homeSize:        1024,
+			shell:           "bash",
+			sessionDuration: 2 * time.Hour,
+			bandwidth:       c.Network.Bandwidth,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			m := c.withProfile(c.Profiles[tt.profile])
+			if m.Cgroups.Memory != tt.memory || m.Cgroups.PIDs != tt.pids || m.Cgroups.CPUTime != tt.cpuTime {
+				t.Errorf("cgroups = %+v, want memory %v, pids %v, cpu time %v", m.Cgroups, tt.memory, tt.pids,
+					tt.cpuTime)
+			}
+			if m.HomeSize != tt.homeSize {
+				t.Errorf("home size = %v, want %v", m.HomeSize, tt.homeSize)
+			}
+			if m.Shell != tt.shell {
+				t.Errorf("shell = %v, want %v", m.Shell, tt.shell)
+			}
+			if m.SessionDuration != tt.sessionDuration {
+				t.Errorf("session duration = %v, want %v", m.SessionDuration, tt.sessionDuration)
+			}
+			if !reflect.DeepEqual(m.Network.Bandwidth, tt.bandwidth) {
+				t.Errorf("bandwidth = %+v, want %+v", m.Network.Bandwidth, tt.bandwidth)
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(c, testProfileConfig()) {
+		t.Errorf("withProfile() modified the global config: %+v", c)
+	}
+}
@@ -0,0 +1,48 @@
+package util
+
+// RingBuffer keeps the last n bytes written to it
+type RingBuffer struct {
+	data  []byte
+	start int
+	full  bool
+}
+
+// NewRingBuffer creates a new RingBuffer of the given size
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{data: make([]byte, 0, size)}
+}
+
+// Write appends data to the buffer, discarding the oldest data if it is full
+func (b *RingBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	size := cap(b.data)
+	if size == 0 {
+		return n, nil
+	}
+	if len(p) > size {
+		p = p[len(p)-size:]
+	}
+
+	for len(p) > 0 {
+		if !b.full {
+			c := copy(b.data[len(b.data):size], p)
+			b.data = b.data[:len(b.data)+c]
+			p = p[c:]
+			b.full = len(b.data) == size
+			continue
+		}
+
+		c := copy(b.data[b.start:], p)
+		b.start = (b.start + c) % size
+		p = p[c:]
+	}
+
+	return n, nil
+}
+
+// Bytes returns a copy of the buffer's contents, oldest first
+func (b *RingBuffer) Bytes() []byte {
+	out := make([]byte, 0, len(b.data))
+	out = append(out, b.data[b.start:]...)
+	return append(out, b.data[:b.start]...)
+}
@@ -0,0 +1,50 @@
+package util
+
+import "testing"
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 4, nil, ""},
+		{"partial", 4, []string{"ab"}, "ab"},
+		{"exactly full", 4, []string{"ab", "cd"}, "abcd"},
+		{"wraps", 4, []string{"abc", "def"}, "cdef"},
+		{"wraps twice", 4, []string{"abc", "def", "ghi"}, "fghi"},
+		{"single bytes", 3, []string{"a", "b", "c", "d", "e"}, "cde"},
+		{"write larger than buffer", 4, []string{"abcdefgh"}, "efgh"},
+		{"larger write after wrap", 4, []string{"abcde", "fghijk"}, "hijk"},
+		{"write ending at boundary", 4, []string{"abcdef", "gh"}, "efgh"},
+		{"empty writes", 4, []string{"", "ab", "", "cde"}, "bcde"},
+		{"zero size", 0, []string{"abc"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewRingBuffer(tt.size)
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %v, %v, want %v, nil", w, n, err, len(w))
+				}
+			}
+
+			if got := string(b.Bytes()); got != tt.want {
+				t.Errorf("Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRingBufferBytesCopy(t *testing.T) {
+	b := NewRingBuffer(4)
+	b.Write([]byte("abcdef"))
+
+	out := b.Bytes()
+	out[0] = 'x'
+	if got := string(b.Bytes()); got != "cdef" {
+		t.Errorf("Bytes() = %q after modifying a previous result, want %q", got, "cdef")
+	}
+}
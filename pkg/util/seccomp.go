@@ -0,0 +1,119 @@
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var syscallRegex = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// SeccompConfig represents the seccomp policy for jails
+type SeccompConfig struct {
+	// Policy is a raw kafel policy, which is used instead of the other options if set
+	Policy string
+
+	// Default is the action (allow, kill, errno or log) for syscalls not in Allow or Deny
+	Default string
+	// Action is the action (kill, errno or log) for syscalls in Deny
+	Action string
+	Deny   []string
+	// Allow lists syscalls which are permitted if Default is not allow
+	Allow []string
+
+	// Log makes nsjail log syscalls which are killed
+	Log bool
+}
+
+// kafelAction converts a configured action into a kafel action
+func kafelAction(action string) (string, error) {
+	switch action {
+	case "allow":
+		return "ALLOW", nil
+	case "kill":
+		return "KILL", nil
+	case "errno":
+		// EPERM
+		return "ERRNO(1)", nil
+	case "log":
+		return "LOG", nil
+	default:
+		return "", fmt.Errorf("unknown seccomp action %v", action)
+	}
+}
+
+func kafelSyscalls(syscalls []string) (string, error) {
+	for _, s := range syscalls {
+		if !syscallRegex.MatchString(s) {
+			return "", fmt.Errorf("invalid syscall name %q", s)
+		}
+	}
+
+	return strings.Join(syscalls, ", "), nil
+}
+
+// policy generates the kafel policy
+func (s *SeccompConfig) policy() (string, error) {
+	if s.Policy != "" {
+		return s.Policy, nil
+	}
+
+	def, err := kafelAction(s.Default)
+	if err != nil {
+		return "", fmt.Errorf("invalid default action: %w", err)
+	}
+
+	var rules []string
+	if len(s.Deny) != 0 {
+		if s.Action == "allow" {
+			return "", fmt.Errorf("deny action must not be allow")
+		}
+		action, err := kafelAction(s.Action)
+		if err != nil {
+			return "", fmt.Errorf("invalid deny action: %w", err)
+		}
+
+		syscalls, err := kafelSyscalls(s.Deny)
+		if err != nil {
+			return "", err
+		}
+		rules = append(rules, fmt.Sprintf("%v { %v }", action, syscalls))
+	}
+	if len(s.Allow) != 0 {
+		if s.Default == "allow" {
+			return "", fmt.Errorf("allowed syscalls have no effect with a default action of allow")
+		}
+
+		syscalls, err := kafelSyscalls(s.Allow)
+		if err != nil {
+			return "", err
+		}
+		rules = append(rules, fmt.Sprintf("ALLOW { %v }", syscalls))
+	}
+
+	if len(rules) == 0 {
+		return "DEFAULT " + def, nil
+	}
+	return fmt.Sprintf("POLICY shh { %v } USE shh DEFAULT %v", strings.Join(rules, ", "), def), nil
+}
+
+// seccompPolicy is the validated kafel policy for jails
+var seccompPolicy string
+
+// initSeccomp generates the seccomp policy and checks that nsjail can compile it (and run a process with it)
+func initSeccomp(c *JailConfig) error {
+	policy, err := c.Seccomp.policy()
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command("nsjail", "--mode", "o", "--quiet", "--chroot", "/", "--disable_clone_newnet",
+		"--seccomp_string", policy, "--", "/bin/true").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nsjail rejected seccomp policy %q: %w (output: %s)", policy, err, out)
+	}
+
+	seccompPolicy = policy
+	return nil
+}
@@ -0,0 +1,103 @@
+package util
+
+import "testing"
+
+func TestSeccompPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  SeccompConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "raw policy",
+			config: SeccompConfig{Policy: "KILL { ptrace } DEFAULT ALLOW", Default: "bogus", Deny: []string{"bad name"}},
+			want:   "KILL { ptrace } DEFAULT ALLOW",
+		},
+		{
+			name:   "default only",
+			config: SeccompConfig{Default: "allow", Action: "errno"},
+			want:   "DEFAULT ALLOW",
+		},
+		{
+			name:   "deny with errno",
+			config: SeccompConfig{Default: "allow", Action: "errno", Deny: []string{"mount", "umount2", "bpf"}},
+			want:   "POLICY shh { ERRNO(1) { mount, umount2, bpf } } USE shh DEFAULT ALLOW",
+		},
+		{
+			name:   "deny with kill",
+			config: SeccompConfig{Default: "allow", Action: "kill", Deny: []string{"kexec_load"}},
+			want:   "POLICY shh { KILL { kexec_load } } USE shh DEFAULT ALLOW",
+		},
+		{
+			name:   "allow list",
+			config: SeccompConfig{Default: "log", Allow: []string{"read", "write"}},
+			want:   "POLICY shh { ALLOW { read, write } } USE shh DEFAULT LOG",
+		},
+		{
+			name: "deny and allow",
+			config: SeccompConfig{Default: "kill", Action: "errno", Deny: []string{"ptrace"},
+				Allow: []string{"read", "exit_group"}},
+			want: "POLICY shh { ERRNO(1) { ptrace }, ALLOW { read, exit_group } } USE shh DEFAULT KILL",
+		},
+		{
+			name:    "unknown default",
+			config:  SeccompConfig{Default: "deny"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown action",
+			config:  SeccompConfig{Default: "allow", Action: "trap", Deny: []string{"ptrace"}},
+			wantErr: true,
+		},
+		{
+			name:    "deny action allow",
+			config:  SeccompConfig{Default: "allow", Action: "allow", Deny: []string{"ptrace"}},
+			wantErr: true,
+		},
+		{
+			name:   "action unused without denied syscalls",
+			config: SeccompConfig{Default: "errno", Action: "allow", Allow: []string{"read"}},
+			want:   "POLICY shh { ALLOW { read } } USE shh DEFAULT ERRNO(1)",
+		},
+		{
+			name:    "allow list with default allow",
+			config:  SeccompConfig{Default: "allow", Allow: []string{"read"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid denied syscall",
+			config:  SeccompConfig{Default: "allow", Action: "errno", Deny: []string{"mount }, ALLOW { ptrace"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid allowed syscall",
+			config:  SeccompConfig{Default: "kill", Allow: []string{"Read"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty syscall",
+			config:  SeccompConfig{Default: "allow", Action: "errno", Deny: []string{""}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.policy()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("policy() = %q, want error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("policy() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("policy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
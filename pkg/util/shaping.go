@@ -0,0 +1,249 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	iam "github.com/netsoc/iam/client"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	shapingMTU     = 1600
+	shapingLatency = 0.05
+)
+
+var shapingRoot = netlink.MakeHandle(1, 0)
+
+// Bandwidth represents rate limits (in bits per second, 0 for unlimited) for a jail
+type Bandwidth struct {
+	// Egress limits traffic sent by the jail
+	Egress uint64
+	// Ingress limits traffic received by the jail
+	Ingress uint64
+}
+
+// BandwidthConfig represents global and per-group jail rate limits
+type BandwidthConfig struct {
+	Bandwidth `mapstructure:",squash"`
+
+	// Groups overrides the global limits for members of IAM groups (see UserGroups())
+	Groups map[string]Bandwidth
+}
+
+// moreGenerous returns the less restrictive of two limits
+func moreGenerous(a, b uint64) uint64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// ForUser returns the limits for a user's jail (the most generous of any matching group overrides, or the global
+// limits if there are none)
+func (c *BandwidthConfig) ForUser(u *iam.User) Bandwidth {
+	var b *Bandwidth
+	for _, g := range UserGroups(u) {
+		override, ok := c.Groups[g]
+		if !ok {
+			continue
+		}
+
+		if b == nil {
+			b = &override
+			continue
+		}
+		b.Egress = moreGenerous(b.Egress, override.Egress)
+		b.Ingress = moreGenerous(b.Ingress, override.Ingress)
+	}
+
+	if b == nil {
+		return c.Bandwidth
+	}
+	return *b
+}
+
+var shapingClasses = struct {
+	sync.Mutex
+	used map[uint16]struct{}
+	next uint16
+}{used: make(map[uint16]struct{}), next: 1}
+
+func allocShapingClass() (uint16, error) {
+	shapingClasses.Lock()
+	defer shapingClasses.Unlock()
+
+	for i := 0; i < 0xfffe; i++ {
+		minor := shapingClasses.next
+		shapingClasses.next++
+		if shapingClasses.next == 0xffff {
+			shapingClasses.next = 1
+		}
+
+		if _, ok := shapingClasses.used[minor]; !ok {
+			shapingClasses.used[minor] = struct{}{}
+			return minor, nil
+		}
+	}
+
+	return 0, errors.New("no free traffic classes")
+}
+
+func freeShapingClass(minor uint16) {
+	shapingClasses.Lock()
+	defer shapingClasses.Unlock()
+
+	delete(shapingClasses.used, minor)
+}
+
+// initShaping sets up the root qdisc on the host veth, under which per-jail ingress classes are added
+func initShaping(hostVeth netlink.Link) error {
+	htb := netlink.NewHtb(netlink.QdiscAttrs{
+		LinkIndex: hostVeth.Attrs().Index,
+		Handle:    shapingRoot,
+		Parent:    netlink.HANDLE_ROOT,
+	})
+	// Unclassified traffic is not shaped
+	htb.Defcls = 0
+	if err := netlink.QdiscReplace(htb); err != nil {
+		return fmt.Errorf("failed to add root qdisc: %w", err)
+	}
+
+	return nil
+}
+
+// dstFilter creates a u32 filter which sends traffic destined for ip to a class
+func dstFilter(link netlink.Link, ip net.IP, classID uint32) *netlink.U32 {
+	f := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    shapingRoot,
+			Priority:  1,
+		},
+		ClassId: classID,
+		Sel: &netlink.TcU32Sel{
+			Flags: nl.TC_U32_TERMINAL,
+		},
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		f.Protocol = unix.ETH_P_IP
+		f.Sel.Keys = []netlink.TcU32Key{{Mask: 0xffffffff, Val: binary.BigEndian.Uint32(v4), Off: 16}}
+	} else {
+		f.Protocol = unix.ETH_P_IPV6
+		f.Priority = 2
+		for i := 0; i < 4; i++ {
+			f.Sel.Keys = append(f.Sel.Keys, netlink.TcU32Key{
+				Mask: 0xffffffff,
+				Val:  binary.BigEndian.Uint32(ip[i*4 : i*4+4]),
+				Off:  24 + int32(i*4),
+			})
+		}
+	}
+	f.Sel.Nkeys = uint8(len(f.Sel.Keys))
+
+	return f
+}
+
+// shapeIngress limits traffic to the jail with a class on the host veth
+func (j *Jail) shapeIngress(rate uint64) error {
+	link, err := netlink.LinkByName(j.config.Network.Interface + "-host")
+	if err != nil {
+		return fmt.Errorf("failed to get host veth: %w", err)
+	}
+
+	minor, err := allocShapingClass()
+	if err != nil {
+		return err
+	}
+	classID := netlink.MakeHandle(1, minor)
+
+	class := netlink.NewHtbClass(netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    shapingRoot,
+		Handle:    classID,
+	}, netlink.HtbClassAttrs{Rate: rate, Ceil: rate})
+	if err := netlink.ClassReplace(class); err != nil {
+		freeShapingClass(minor)
+		return fmt.Errorf("failed to add traffic class: %w", err)
+	}
+	j.shapingClass = minor
+
+	for _, ip := range []net.IP{j.IP, j.IP6} {
+		if ip == nil {
+			continue
+		}
+
+		if err := netlink.FilterAdd(dstFilter(link, ip, classID)); err != nil {
+			return fmt.Errorf("failed to add traffic filter for %v: %w", ip, err)
+		}
+	}
+
+	return nil
+}
+
+// unshape removes the jail's ingress traffic class and filters
+func (j *Jail) unshape() error {
+	if j.shapingClass == 0 {
+		return nil
+	}
+	defer freeShapingClass(j.shapingClass)
+
+	link, err := netlink.LinkByName(j.config.Network.Interface + "-host")
+	if err != nil {
+		return fmt.Errorf("failed to get host veth: %w", err)
+	}
+
+	classID := netlink.MakeHandle(1, j.shapingClass)
+	filters, err := netlink.FilterList(link, shapingRoot)
+	if err != nil {
+		return fmt.Errorf("failed to list traffic filters: %w", err)
+	}
+	for _, f := range filters {
+		if u32, ok := f.(*netlink.U32); ok && u32.ClassId == classID {
+			if err := netlink.FilterDel(f); err != nil {
+				return fmt.Errorf("failed to delete traffic filter: %w", err)
+			}
+		}
+	}
+
+	if err := netlink.ClassDel(&netlink.HtbClass{ClassAttrs: netlink.ClassAttrs{
+		LinkIndex: link.Attrs().Index,
+		Parent:    shapingRoot,
+		Handle:    classID,
+	}}); err != nil {
+		return fmt.Errorf("failed to delete traffic class: %w", err)
+	}
+
+	return nil
+}
+
+// shapeEgress limits traffic from the jail with a token bucket on its own interface (which the jail is not privileged
+// to change)
+func (j *Jail) shapeEgress(h *netlink.Handle, link netlink.Link, rate uint64) error {
+	bytesRate := rate / 8
+	burst := uint32(float64(bytesRate)/netlink.Hz()) + shapingMTU
+	tbf := &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   bytesRate,
+		Limit:  uint32(float64(bytesRate)*shapingLatency) + burst,
+		Buffer: uint32(netlink.Xmittime(bytesRate, burst)),
+	}
+	if err := h.QdiscReplace(tbf); err != nil {
+		return fmt.Errorf("failed to add token bucket qdisc: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// shellQuote quotes a string for POSIX shells (and zsh)
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote quotes a string for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// shellRCFile is a generated startup file for a shell
+type shellRCFile struct {
+	Path    string
+	Content []byte
+}
+
+// fishRC sets PATH and the greeting for fish (completions for the CLI are installed in the image)
+func fishRC(pathEnv, greeting string) []shellRCFile {
+	var b bytes.Buffer
+	b.WriteString("set -gx PATH")
+	for _, p := range strings.Split(pathEnv, ":") {
+		b.WriteString(" " + fishQuote(p))
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "function fish_greeting\n    printf '%%s' %v\nend\n", fishQuote(greeting))
+	return []shellRCFile{{Path: "/etc/fish/config.fish", Content: b.Bytes()}}
+}
+
+// profileRC sets PATH and the greeting for login shells which read /etc/profile (bash and other POSIX shells)
+func profileRC(pathEnv, greeting string) []shellRCFile {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "export PATH=%v\n", shellQuote(pathEnv))
+	fmt.Fprintf(&b, "case $- in\n*i*)\n")
+	fmt.Fprintf(&b, "    if [ -n \"$BASH_VERSION\" ] && [ -r /usr/share/bash-completion/bash_completion ]; then\n")
+	fmt.Fprintf(&b, "        . /usr/share/bash-completion/bash_completion\n")
+	fmt.Fprintf(&b, "    fi\n")
+	fmt.Fprintf(&b, "    printf '%%s' %v\n", shellQuote(greeting))
+	fmt.Fprintf(&b, "    ;;\nesac\n")
+
+	return []shellRCFile{{Path: "/etc/profile", Content: b.Bytes()}}
+}
+
+// zshRC sets PATH (for all shells) and the greeting and completions (for interactive shells) for zsh
+func zshRC(pathEnv, greeting string) []shellRCFile {
+	env := fmt.Sprintf("export PATH=%v\n", shellQuote(pathEnv))
+
+	var rc bytes.Buffer
+	fmt.Fprintf(&rc, "autoload -Uz compinit && compinit -d \"$HOME/.zcompdump\"\n")
+	fmt.Fprintf(&rc, "printf '%%s' %v\n", shellQuote(greeting))
+
+	return []shellRCFile{
+		{Path: "/etc/zsh/zshenv", Content: []byte(env)},
+		{Path: "/etc/zsh/zshrc", Content: rc.Bytes()},
+	}
+}
+
+// shellRCFiles generates the startup files for a shell, based on the name of its executable
+func shellRCFiles(shell, pathEnv, greeting string) []shellRCFile {
+	switch path.Base(shell) {
+	case "fish":
+		return fishRC(pathEnv, greeting)
+	case "zsh":
+		return zshRC(pathEnv, greeting)
+	default:
+		return profileRC(pathEnv, greeting)
+	}
+}
+
+// ShellPath returns the path to a shell by name (or an error if it isn't configured or installed)
+func (c *JailConfig) ShellPath(name string) (string, error) {
+	p, ok := c.Shells[name]
+	if !ok {
+		return "", fmt.Errorf("unknown shell %v", name)
+	}
+
+	// Shells in the jail come from the host's bind mounts
+	if _, err := os.Stat(p); err != nil {
+		return "", fmt.Errorf("shell %v is not installed", name)
+	}
+
+	return p, nil
+}
+
+// ShellNames returns the names of the configured shells
+func (c *JailConfig) ShellNames() []string {
+	names := make([]string, 0, len(c.Shells))
+	for name := range c.Shells {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
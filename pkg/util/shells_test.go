@@ -0,0 +1,98 @@
+package util
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellRCFiles(t *testing.T) {
+	const pathEnv = "/usr/local/bin:/it's/bin"
+	const greeting = "Hello 'there' \\ $USER\n"
+
+	fish := "set -gx PATH '/usr/local/bin' '/it\\'s/bin'\n" +
+		"function fish_greeting\n    printf '%s' 'Hello \\'there\\' \\\\ $USER\n'\nend\n"
+	profile := "export PATH='/usr/local/bin:/it'\\''s/bin'\n" +
+		"case $- in\n*i*)\n" +
+		"    if [ -n \"$BASH_VERSION\" ] && [ -r /usr/share/bash-completion/bash_completion ]; then\n" +
+		"        . /usr/share/bash-completion/bash_completion\n" +
+		"    fi\n" +
+		"    printf '%s' 'Hello '\\''there'\\'' \\ $USER\n'\n" +
+		"    ;;\nesac\n"
+	zshenv := "export PATH='/usr/local/bin:/it'\\''s/bin'\n"
+	zshrc := "autoload -Uz compinit && compinit -d \"$HOME/.zcompdump\"\n" +
+		"printf '%s' 'Hello '\\''there'\\'' \\ $USER\n'\n"
+
+	tests := []struct {
+		shell string
+		want  []shellRCFile
+	}{
+		{"/usr/bin/fish", []shellRCFile{{"/etc/fish/config.fish", []byte(fish)}}},
+		{"/bin/zsh", []shellRCFile{{"/etc/zsh/zshenv", []byte(zshenv)}, {"/etc/zsh/zshrc", []byte(zshrc)}}},
+		{"/bin/bash", []shellRCFile{{"/etc/profile", []byte(profile)}}},
+		{"/bin/sh", []shellRCFile{{"/etc/profile", []byte(profile)}}},
+		{"/usr/bin/fish/", []shellRCFile{{"/etc/fish/config.fish", []byte(fish)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			got := shellRCFiles(tt.shell, pathEnv, greeting)
+			if len(got) != len(tt.want) {
+				t.Fatalf("shellRCFiles(%v) returned %v files, want %v", tt.shell, len(got), len(tt.want))
+			}
+
+			for i, f := range got {
+				if f.Path != tt.want[i].Path {
+					t.Errorf("file %v is %v, want %v", i, f.Path, tt.want[i].Path)
+				}
+				if string(f.Content) != string(tt.want[i].Content) {
+					t.Errorf("%v = %q, want %q", f.Path, f.Content, tt.want[i].Content)
+				}
+			}
+		})
+	}
+}
+
+func TestShellRCFilesRun(t *testing.T) {
+	const pathEnv = "/usr/bin:/it's/bin"
+	const greeting = "Hello 'there' \\ $USER `id`\n"
+
+	for _, shell := range []string{"sh", "bash", "zsh", "fish"} {
+		t.Run(shell, func(t *testing.T) {
+			bin, err := exec.LookPath(shell)
+			if err != nil {
+				t.Skipf("%v is not installed", shell)
+			}
+
+			var script strings.Builder
+			for _, f := range shellRCFiles(bin, pathEnv, greeting) {
+				script.Write(f.Content)
+			}
+			if shell == "fish" {
+				script.WriteString("fish_greeting\nprintf '%s\\n' (string join : $PATH)\n")
+			} else {
+				script.WriteString("printf '%s\\n' \"$PATH\"\n")
+			}
+
+			// Interactive so the greeting is printed by POSIX shells (zsh without the host's startup files, which
+			// might run the new user wizard)
+			args := []string{"-c", script.String()}
+			switch shell {
+			case "zsh":
+				args = append([]string{"-f", "-i"}, args...)
+			case "sh", "bash":
+				args = append([]string{"-i"}, args...)
+			}
+			cmd := exec.Command(bin, args...)
+			cmd.Env = []string{"HOME=" + t.TempDir(), "USER=nobody"}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("failed to run startup files with %v: %v", shell, err)
+			}
+
+			if want := greeting + pathEnv + "\n"; !strings.HasSuffix(string(out), want) {
+				t.Errorf("%v printed %q, want %q", shell, out, want)
+			}
+		})
+	}
+}
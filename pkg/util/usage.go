@@ -0,0 +1,243 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// limitCheckInterval is how often a jail's cgroups are checked for limits being hit
+	limitCheckInterval = time.Second
+	// usageSampleInterval is how often a jail's full resource usage (including network statistics) is sampled (so
+	// it's known even if the jail exits unexpectedly)
+	usageSampleInterval = 5 * time.Second
+)
+
+// LimitEvent indicates that a jail hit one of its resource limits
+type LimitEvent struct {
+	// Resource is either memory or pids
+	Resource string
+	// Count is the number of times the limit was hit since the last event
+	Count uint64
+	Limit uint64
+	// Current is the usage after the limit was hit
+	Current uint64
+}
+
+// JailUsage represents the resources consumed by a jail
+type JailUsage struct {
+	Duration   time.Duration
+	PeakMemory uint64
+	CPUTime    time.Duration
+	PeakPIDs   uint64
+	OOMKills   uint64
+	// PIDLimitHits is the number of times forking failed due to the pids limit
+	PIDLimitHits uint64
+
+	RxBytes uint64
+	TxBytes uint64
+}
+
+type jailUsage struct {
+	sync.Mutex
+	JailUsage
+
+	started time.Time
+	ended   time.Time
+	// cgroups maps controllers to the jail's cgroup directories
+	cgroups map[string]string
+
+	onLimit func(LimitEvent)
+}
+
+// cgroupPaths finds the (v1) cgroup directories of a process by controller
+func cgroupPaths(pid int) (map[string]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%v/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	paths := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller != "" {
+				paths[controller] = path.Join("/sys/fs/cgroup", controller, fields[2])
+			}
+		}
+	}
+
+	return paths, s.Err()
+}
+
+func readCgroupUint(dir, file string) (uint64, error) {
+	data, err := os.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKeyed reads a cgroup file of "key value" lines
+func readCgroupKeyed(dir, file string) (map[string]uint64, error) {
+	data, err := os.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]uint64)
+	for _, l := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			continue
+		}
+
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			values[fields[0]] = v
+		}
+	}
+
+	return values, nil
+}
+
+// sampleUsage updates the jail's resource usage from its cgroups (and network interface if network is set),
+// notifying the limit handler of any limits hit since the last sample
+func (j *Jail) sampleUsage(network bool) {
+	var events []LimitEvent
+	j.usage.Lock()
+	onLimit := j.usage.onLimit
+	defer func() {
+		j.usage.Unlock()
+
+		// The handler might block (e.g. writing to sessions), which mustn't hold up sampling or stopping the jail
+		if onLimit != nil && len(events) != 0 {
+			go func() {
+				for _, e := range events {
+					onLimit(e)
+				}
+			}()
+		}
+	}()
+
+	u := &j.usage
+	if u.ended.IsZero() {
+		u.Duration = time.Since(u.started)
+	} else {
+		u.Duration = u.ended.Sub(u.started)
+	}
+	select {
+	case <-j.done:
+		// Everything below is gone once the jail has exited
+		return
+	default:
+	}
+
+	if u.cgroups == nil {
+		paths, err := cgroupPaths(j.pid)
+		if err != nil {
+			return
+		}
+		u.cgroups = paths
+	}
+
+	if dir, ok := u.cgroups["memory"]; ok {
+		if v, err := readCgroupUint(dir, "memory.max_usage_in_bytes"); err == nil {
+			u.PeakMemory = v
+		}
+		if oom, err := readCgroupKeyed(dir, "memory.oom_control"); err == nil && oom["oom_kill"] > u.OOMKills {
+			current, _ := readCgroupUint(dir, "memory.usage_in_bytes")
+			events = append(events, LimitEvent{
+				Resource: "memory",
+				Count:    oom["oom_kill"] - u.OOMKills,
+				Limit:    j.config.Cgroups.Memory,
+				Current:  current,
+			})
+			u.OOMKills = oom["oom_kill"]
+		}
+	}
+	if dir, ok := u.cgroups["cpuacct"]; ok {
+		if v, err := readCgroupUint(dir, "cpuacct.usage"); err == nil {
+			u.CPUTime = time.Duration(v)
+		}
+	}
+	if dir, ok := u.cgroups["pids"]; ok {
+		if v, err := readCgroupUint(dir, "pids.current"); err == nil && v > u.PeakPIDs {
+			u.PeakPIDs = v
+		}
+		if pidEvents, err := readCgroupKeyed(dir, "pids.events"); err == nil && pidEvents["max"] > u.PIDLimitHits {
+			current, _ := readCgroupUint(dir, "pids.current")
+			events = append(events, LimitEvent{
+				Resource: "pids",
+				Count:    pidEvents["max"] - u.PIDLimitHits,
+				Limit:    j.config.Cgroups.PIDs,
+				Current:  current,
+			})
+			u.PIDLimitHits = pidEvents["max"]
+		}
+	}
+
+	if network && j.config.Network.Interface != "" {
+		j.inNetns(func(h *netlink.Handle, link netlink.Link) error {
+			if stats := link.Attrs().Statistics; stats != nil {
+				u.RxBytes = stats.RxBytes
+				u.TxBytes = stats.TxBytes
+			}
+			return nil
+		})
+	}
+}
+
+// monitor periodically samples the jail's resource usage until it exits
+func (j *Jail) monitor() {
+	t := time.NewTicker(limitCheckInterval)
+	defer t.Stop()
+
+	lastFull := time.Now()
+	j.sampleUsage(true)
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-t.C:
+		}
+
+		full := time.Since(lastFull) >= usageSampleInterval
+		if full {
+			lastFull = time.Now()
+		}
+		j.sampleUsage(full)
+	}
+}
+
+// OnLimit sets a function which is called (from a separate goroutine) when the jail hits one of its resource limits
+func (j *Jail) OnLimit(f func(LimitEvent)) {
+	j.usage.Lock()
+	defer j.usage.Unlock()
+
+	j.usage.onLimit = f
+}
+
+// Usage returns the jail's resource usage (as of the last sample if the jail has exited)
+func (j *Jail) Usage() JailUsage {
+	j.sampleUsage(true)
+
+	j.usage.Lock()
+	defer j.usage.Unlock()
+
+	return j.usage.JailUsage
+}
@@ -4,19 +4,24 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"strconv"
-	"strings"
 	"syscall"
-	"text/template"
 
 	"github.com/creack/pty"
 	"github.com/gliderlabs/ssh"
 	iam "github.com/netsoc/iam/client"
 )
 
-var TemplateFuncs = template.FuncMap{
-	"bytesToCString": BytesToCString,
-	"toBytes":        func(s string) []byte { return []byte(s) },
+// UserGroups returns the groups (derived from IAM attributes) which a user belongs to
+func UserGroups(u *iam.User) []string {
+	var groups []string
+	if u.IsAdmin != nil && *u.IsAdmin {
+		groups = append(groups, "admin")
+	}
+	if u.Verified != nil && *u.Verified {
+		groups = append(groups, "verified")
+	}
+
+	return groups
 }
 
 // SSHToPTYSize converts an SSH window size to pty window size
@@ -86,13 +91,3 @@ func APIError(err error) error {
 
 	return err
 }
-
-func BytesToCString(data []byte) string {
-	var sb strings.Builder
-	for _, b := range data {
-		sb.WriteString(`\x`)
-		sb.WriteString(strconv.FormatUint(uint64(b), 16))
-	}
-
-	return sb.String()
-}